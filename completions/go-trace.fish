@@ -1,7 +1,92 @@
-set -l gotrace_commands
-complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "-h" -d 'Shows the help'
-complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "--help" -d 'Shows the help'
-complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "-j" -d 'Outputs results as JSON'
-complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "-s" -d 'Outputs only the final/clean URL'
-complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "-v" -d 'Shows all results in tabular format'
-complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "-w" -d 'Sets the width of the URL column when using -v. (Ex: -w 120)'
+set -l gotrace_commands trace batch version
+complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "trace" -d 'Traces a single URL'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "batch" -d 'Traces the URLs in a file (-f or -fj)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from $gotrace_commands" -a "version" -d 'Prints the version'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-allow-downgrade-once" -d 'Allows one https -> http redirect mid-chain'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-arrow" -d 'Outputs the chain on one line, joined with ->'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-arrow-hosts" -d 'Like -arrow, with just the hosts'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-b64-params" -d 'Decodes these query params as base64 redirect URLs'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-base" -d 'Resolves the URLs given against this one (Ex: -base https://example.com)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-browser" -d 'Sends a full desktop browser header set'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-bytes" -d 'Shows how many bytes each hop sent and received'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-cacert" -d 'Also trusts the CAs in a PEM file'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-canonical" -d 'Also outputs a canonical form of the clean URL'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-cert" -d 'Presents a client certificate for mutual TLS'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-compare-ua" -d 'Traces again with another User-Agent to detect cloaking'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-compact" -d 'Outputs JSON on a single line'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-content-type" -d 'Sets the Content-Type sent with -data'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-cookie-jar" -d 'Loads and saves cookies in a Netscape-format file'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-count" -d 'Outputs only the number of redirects'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-data" -d 'Sends a body with the first request'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-dot" -d 'Outputs the chain as a Graphviz DOT graph'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-expect-final" -d 'Flags a final URL not matching this host or URL pattern'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-expect-type" -d 'Flags a final response not of these types (Ex: -expect-type image/*)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-fail-on-error" -d 'Exits nonzero when the final response is not 2xx'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-f" -d 'Reads URLs to trace from a file, one per line (- for stdin)'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-fj" -d 'Reads URLs to trace from a JSON array (- for stdin)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-follow-codes" -d 'Sets the redirect codes to follow (Ex: -follow-codes 301,302)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-group-by-final" -d 'Groups batch results by the host they end at'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-H" -d 'Sends an extra header (Ex: -H "Accept: text/html")'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-h" -d 'Shows the help'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "--help" -d 'Shows the help'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-har" -d 'Writes the trace as a HAR file (- for stdout)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-head-then-get" -d 'Tries HEAD on each hop, falling back to GET'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-hop" -d 'Outputs only hop N (Ex: -hop -1 for the last)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-hop-timeout" -d 'Caps the time for any one hop (Ex: -hop-timeout 2s)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-host-count" -d 'Outputs only the number of distinct hosts'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-http3" -d 'Tries HTTP/3 first, falling back to TCP'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-i" -d 'Pauses for Enter before following each redirect'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-interface" -d 'Sends requests from a local IP or interface (Ex: -interface eth0)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-interesting" -d 'Folds runs of unremarkable hops in verbose output'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-j" -d 'Outputs results as JSON'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-key" -d 'Private key for -cert'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-lang" -d 'Sends Accept-Language (Ex: -lang de-DE)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-list-hops" -d 'Outputs each hop URL on its own line'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-log-json" -d 'Logs trace events to stderr as JSON lines'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-max-body" -d 'Reads at most N bytes of a response body'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-max-hops" -d 'Gives up after N hops (default: 20)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-max-host-changes" -d 'Stops after the chain changes host N times'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-max-per-host" -d 'Declares a loop once any host is visited more than N times'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-max-total-bytes" -d 'Stops once N body bytes have been read across the chain'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-meta" -d 'Flags 3xx pages whose meta refresh disagrees with Location'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-method" -d 'Sets the HTTP method for the first request (Ex: -method POST)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-netrc" -d 'Sends Basic Auth from ~/.netrc to matching hosts'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-no-body" -d 'Closes responses without reading their bodies'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-no-cache" -d 'Traces repeated URLs in a batch again'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-no-color" -d 'Turns off colors in the output'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-no-downgrade" -d 'Aborts if a redirect goes from https to http'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-no-keepalive" -d 'Uses a fresh connection for every request'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-no-unwrap" -d 'Follows Location exactly, without unwrapping returnUri/redir params'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-normalize-encoding" -d 'Percent-encodes the final URL consistently'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-otel" -d 'Sends the trace to an OpenTelemetry collector as spans'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-peek" -d 'Shows where a link redirects without following it'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-profile" -d 'Uses a profile of flags from the config file'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-proxy" -d 'Sends requests through a proxy (Ex: -proxy socks5://127.0.0.1:1080)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-quiet" -d 'Hides the progress indicator in batch mode'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-record" -d 'Saves each request and response to a directory'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-replay" -d 'Replays a trace from a -record directory'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-require-https" -d 'Flags any hop fetched over plain http'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-resolve" -d 'Forces a host to resolve to an IP (Ex: -resolve example.com:127.0.0.1 or example.com:443:127.0.0.1)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-s" -d 'Outputs only the final/clean URL'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-same-origin" -d 'Stops at the first redirect off the starting origin'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-sanitize" -d 'Masks logins and secret query values in the output'
+complete -c go-trace -n "not __fish_seen_subcommand_from version" -a "-save-body" -d 'Writes the final response body to a file'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-sort" -d 'Orders batch results by input, hops, status or final'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-sort-query" -d 'Sorts the clean URL query parameters alphabetically'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-stop-on-tracking" -d 'Stops at the first redirect that adds a tracking parameter'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-stream" -d 'Prints each hop as soon as it is fetched'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-syslog" -d 'Sends a summary of each trace to a syslog server'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-template" -d 'Formats each result with a Go text/template'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-timestamps" -d 'Records when each hop started'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-tls-ciphers" -d 'Offers only these TLS 1.0-1.2 cipher suites'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-tls-min" -d 'Sets the oldest TLS version offered (Ex: -tls-min 1.0)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-trace-to-stderr" -d 'Prints the trace to stderr and only the clean URL to stdout'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-trim-slash" -d 'Drops a trailing slash from the clean URL'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-tsv" -d 'Outputs one tab-separated row per hop'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-tsv-header" -d 'Outputs tab-separated rows with a header row'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-u" -d 'Logs in to the starting host (Ex: -u user:password)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-ua" -d 'Sets the User-Agent'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-url-deadline" -d 'Caps the time spent tracing each URL (Ex: -url-deadline 3s)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-v" -d 'Shows all results in tabular format'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-warn-hops" -d 'Warns when a chain has more than N hops (Ex: -warn-hops 5)'
+complete -f -c go-trace -n "not __fish_seen_subcommand_from version" -a "-w" -d 'Sets the width of the URL column when using -v, instead of fitting the terminal. (Ex: -w 120)'
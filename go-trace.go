@@ -1,78 +1,551 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/pelletier/go-toml/v2"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
 )
 
-const (
+// schemaVersion identifies the shape of the JSON output
+// Bump it whenever a field is added, renamed or removed from TraceResult or Hop, or the output is wrapped differently.
+const schemaVersion = 30
+
+// The User-Agent sent unless -ua says otherwise: an ordinary desktop browser, so sites don't treat the trace as a bot
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+
+// The headers -browser sends: what a current desktop Chrome sends when a link is opened in a new tab.
+// When updating the Chrome version, keep the User-Agent and Sec-Ch-Ua versions in step.
+var browserHeaders = http.Header{
+	"User-Agent":                {"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36"},
+	"Accept":                    {"text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"},
+	"Accept-Encoding":           {"gzip, deflate, br, zstd"},
+	"Accept-Language":           {"en-US,en;q=0.9"},
+	"Sec-Ch-Ua":                 {`"Google Chrome";v="141", "Not?A_Brand";v="8", "Chromium";v="141"`},
+	"Sec-Ch-Ua-Mobile":          {"?0"},
+	"Sec-Ch-Ua-Platform":        {`"Windows"`},
+	"Sec-Fetch-Dest":            {"document"},
+	"Sec-Fetch-Mode":            {"navigate"},
+	"Sec-Fetch-Site":            {"none"},
+	"Sec-Fetch-User":            {"?1"},
+	"Upgrade-Insecure-Requests": {"1"},
+}
+
+// Terminal colors. These are blanked out by -no-color (or NO_COLOR in the environment).
+var (
 	bold       = "\033[1m"
 	boldBlue   = "\033[1;34m"
 	brightCyan = "\033[38;5;14m"
 	green      = "\033[32m"
+	magenta    = "\033[35m"
+	red        = "\033[31m"
 	reset      = "\033[0m"
 	underline  = "\033[4m"
+	yellow     = "\033[33m"
 )
 
 var (
-	client             = createHTTPClient()
+	client             = createHTTPClient(ClientOptions{})
 	outputWidth        = 120
 	outputDividerWidth = 135
+	warnHops           = 0 // 0 disables the long-chain warning
+	canonicalize       = false
+	trimSlash          = false
+	normalizeEncoding  = false
+	sortQuery          = false
+	quiet              = false
+	compactJSON        = false
+	sanitize           = false
+	interestingOnly    = false
+	showTLS            = false
+	outputTemplate     *template.Template // set by -template
+	urlOut             io.Writer          // with -trace-to-stderr, the real stdout, which gets just the URL
+	selectedHop        = 0                // set by -hop; negative counts from the end
+	hopWithStatus      = false            // -hop -v also prints the hop's status
+	tsvSource          = false            // -tsv rows start with the URL that was traced (batch mode)
+	arrowHosts         = false            // -arrow-hosts joins hosts rather than whole URLs
+	showBytes          = false            // -bytes shows what each hop sent and received in verbose output
+	streamed           = false            // -stream has already printed the hops, so the table only needs its footer
+)
+
+// Functions available to -template
+var templateFuncs = template.FuncMap{
+	"clean":       makeCleanURL,
+	"host":        hostOf,
+	"statusClass": statusClass,
+}
+
+// Errors that end a trace early
+var (
+	ErrCloudflare        = errors.New("cloudflare protection prevents tracing")
+	ErrConnectionRefused = errors.New("the connection was refused (possibly because of DNS)")
+	ErrTimeout           = errors.New("the request timed out")
+	ErrCertValidation    = errors.New("there was a certification validation error")
+	ErrDowngrade         = errors.New("redirect downgraded from https to http")
+	ErrBadFinalStatus    = errors.New("the final response wasn't 2xx")
+	ErrTooManyRedirects  = errors.New("too many redirects")
+	ErrCyclicRedirect    = errors.New("the chain is cycling through the same hosts")
+	ErrUnexpectedType    = errors.New("the final response wasn't an expected content type")
+	ErrUnexpectedFinal   = errors.New("the final URL wasn't an expected destination")
+	ErrInsecureHop       = errors.New("the chain went over plain http")
+	ErrByteBudget        = errors.New("the trace read more bytes than -max-total-bytes allows")
+	ErrBlocked           = errors.New("a CDN or WAF blocked the trace")
+	ErrHopTimeout        = errors.New("a hop got no response within -hop-timeout")
+	ErrURLDeadline       = errors.New("the trace ran out of its -url-deadline")
 )
 
+// keepsResult reports whether err ended a trace that still has a chain worth showing.
+// These are reported after the usual output, where other errors replace it.
+func keepsResult(err error) bool {
+	return errors.Is(err, ErrBadFinalStatus) || errors.Is(err, ErrUnexpectedType) || errors.Is(err, ErrUnexpectedFinal) ||
+		errors.Is(err, ErrInsecureHop) || errors.Is(err, ErrByteBudget) || errors.Is(err, ErrBlocked) || errors.Is(err, ErrHopTimeout) ||
+		errors.Is(err, ErrURLDeadline) || cutShort(err)
+}
+
+// cutShort reports whether err stopped a chain partway, before it got to (or accepted) a landing page.
+// The hops up to there are still shown, the downgrade included.
+func cutShort(err error) bool {
+	return errors.Is(err, ErrTooManyRedirects) || errors.Is(err, ErrCyclicRedirect) || errors.Is(err, ErrDowngrade)
+}
+
+// Known URL shorteners, by hostname. Extra entries can be added in the config file.
+var knownShorteners = map[string]string{
+	"amzn.to":     "Amazon",
+	"bit.ly":      "Bitly",
+	"bitly.com":   "Bitly",
+	"buff.ly":     "Buffer",
+	"cutt.ly":     "Cuttly",
+	"fb.me":       "Facebook",
+	"goo.gl":      "Google",
+	"is.gd":       "is.gd",
+	"j.mp":        "Bitly",
+	"lnkd.in":     "LinkedIn",
+	"ow.ly":       "Hootsuite",
+	"rebrand.ly":  "Rebrandly",
+	"shorturl.at": "ShortURL",
+	"t.co":        "Twitter",
+	"t.ly":        "T.LY",
+	"tiny.cc":     "tiny.cc",
+	"tinyurl.com": "TinyURL",
+	"v.gd":        "v.gd",
+	"youtu.be":    "YouTube",
+}
+
+// Query parameters whose values -sanitize masks. Extra names can be added in the config file.
+var sensitiveParams = map[string]bool{
+	"access_token":  true,
+	"api_key":       true,
+	"apikey":        true,
+	"auth":          true,
+	"client_secret": true,
+	"code":          true,
+	"key":           true,
+	"password":      true,
+	"refresh_token": true,
+	"secret":        true,
+	"session":       true,
+	"sig":           true,
+	"signature":     true,
+	"token":         true,
+}
+
 // Config struct to hold configuration values
+// The keys are the same in every format the config file can be written in.
 type Config struct {
-	UseJSON       bool `toml:"use_json"`
-	AlwaysTerse   bool `toml:"always_terse"`
-	AlwaysVerbose bool `toml:"always_verbose"`
-	Width         int  `toml:"width"`
+	UseJSON         bool              `toml:"use_json" yaml:"use_json" json:"use_json"`
+	AlwaysTerse     bool              `toml:"always_terse" yaml:"always_terse" json:"always_terse"`
+	AlwaysVerbose   bool              `toml:"always_verbose" yaml:"always_verbose" json:"always_verbose"`
+	Width           int               `toml:"width" yaml:"width" json:"width"`
+	Shorteners      map[string]string `toml:"shorteners" yaml:"shorteners" json:"shorteners"`
+	SensitiveParams []string          `toml:"sensitive_params" yaml:"sensitive_params" json:"sensitive_params"`
+	Proxies         map[string]string `toml:"proxies" yaml:"proxies" json:"proxies"`
+	B64Params       []string          `toml:"b64_params" yaml:"b64_params" json:"b64_params"`
+
+	// Profiles are named sets of flags, flag name to value, for -profile
+	Profiles map[string]map[string]any `toml:"profiles" yaml:"profiles" json:"profiles"`
+
+	// Connection pool tuning, for big batch runs
+	MaxIdleConns        int    `toml:"max_idle_conns" yaml:"max_idle_conns" json:"max_idle_conns"`
+	MaxIdleConnsPerHost int    `toml:"max_idle_conns_per_host" yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	IdleConnTimeout     string `toml:"idle_conn_timeout" yaml:"idle_conn_timeout" json:"idle_conn_timeout"`
+}
+
+// configFiles are the config files looked for, in order of precedence: the first one found is the one read
+var configFiles = []struct {
+	name      string
+	unmarshal func([]byte, any) error
+}{
+	{"go-trace.toml", toml.Unmarshal},
+	{"go-trace.yaml", yaml.Unmarshal},
+	{"go-trace.yml", yaml.Unmarshal},
+	{"go-trace.json", json.Unmarshal},
+}
+
+// ClientOptions holds the settings used to build the HTTP client
+type ClientOptions struct {
+	// Resolve maps a hostname, or a host:port pair for just that port, to the IP address it should be dialed at
+	Resolve map[string]string
+	// HTTP3 tries QUIC first for https URLs, falling back to the usual TCP transport: HTTP/2 where the server
+	// offers it over TLS, HTTP/1.1 otherwise
+	HTTP3 bool
+	// TLSMinVersion is the oldest TLS version offered (0 for Go's default, TLS 1.2)
+	TLSMinVersion uint16
+	// TLSCiphers restricts the TLS 1.0-1.2 cipher suites offered (TLS 1.3 suites can't be chosen)
+	TLSCiphers []uint16
+	// LocalAddr, if set, is the source address requests are sent from
+	LocalAddr net.IP
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout tune the pool of kept-alive connections,
+	// as on http.Transport (0 keeps Go's defaults: no overall limit, 2 per host, no timeout)
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// NoKeepAlive opens a fresh connection for every request
+	NoKeepAlive bool
+	// RootCAs, if set, are the CAs trusted to sign server certificates
+	RootCAs *x509.CertPool
+	// Certificates are offered to servers that ask for a client certificate (mutual TLS)
+	Certificates []tls.Certificate
+	// Proxies maps host patterns ("example.com", "*.cn") to the proxy that reaches them; "default" covers the rest
+	Proxies map[string]*url.URL
+}
+
+// TraceOptions controls how followRedirects walks a chain
+type TraceOptions struct {
+	// FailOnError returns ErrBadFinalStatus, along with the hops, when the landing page isn't 2xx
+	// (or ErrUnexpectedType when it doesn't match ExpectTypes, ErrUnexpectedFinal when it isn't one of ExpectFinal,
+	// or ErrInsecureHop when RequireHTTPS found a plain http hop)
+	FailOnError bool
+	// RequireHTTPS marks every hop fetched over plain http as Insecure
+	RequireHTTPS bool
+	// ExpectTypes lists the media types the landing page may serve; "image/*" matches any image
+	ExpectTypes []string
+	// ExpectFinal lists where the chain may end: hosts ("example.com", "*.example.com") or URLs, where * matches anything
+	ExpectFinal []string
+	// NoDowngrade aborts the trace on any https -> http redirect
+	NoDowngrade bool
+	// AllowDowngradeOnce permits a single https -> http redirect, as long as it isn't the final landing
+	AllowDowngradeOnce bool
+	// NoUnwrap follows Location as sent, without decoding returnUri/redir params
+	NoUnwrap bool
+	// B64Params are query parameters whose value may be a base64-encoded URL; one that decodes to an
+	// http(s) URL is recorded on the hop and followed in place of the Location (unless NoUnwrap)
+	B64Params []string
+	// Method is the method for the first request (GET if empty, or POST when there is Data)
+	Method string
+	// Data is the body sent with the first request, and with any 307/308 that repeats it
+	Data string
+	// ContentType is sent along with Data
+	ContentType string
+	// Timestamps records the wall-clock time each hop's request started
+	Timestamps bool
+	// URLDeadline caps the time spent on the whole chain (0 for no cap). Running out ends the trace with ErrURLDeadline,
+	// the URL it was fetching recorded as not followed.
+	URLDeadline time.Duration
+	// HopTimeout caps each hop on its own (0 for no cap). A hop that already has its Location when it runs over
+	// is marked TimedOut and followed; one that got no response at all ends the trace.
+	HopTimeout time.Duration
+	// HeadThenGet tries each GET hop as a HEAD first, repeating it as a GET if no Location comes back
+	HeadThenGet bool
+	// Client sends the requests; the package-level client is used when nil.
+	// Its redirect policy is overridden so that every hop is seen.
+	Client *http.Client
+	// Transport, if set, replaces the client's transport (for record/replay, auth middleware, fault injection...)
+	Transport http.RoundTripper
+	// SaveBody, if set, is the file the final response body is written to
+	SaveBody string
+	// NoBody closes every response without reading any of its body, at the cost of reusing connections
+	NoBody bool
+	// MaxBody caps how many bytes of a body are read (0 for no limit)
+	MaxBody int64
+	// MaxTotalBytes caps the body bytes read across the whole chain (0 for no limit).
+	// Going over it ends the trace with ErrByteBudget, along with the hops so far.
+	MaxTotalBytes int64
+	// FollowCodes are the status codes whose Location is followed (nil for defaultFollowCodes)
+	FollowCodes []int
+	// Capture keeps each hop's start time and request/response headers, which -har needs
+	Capture bool
+	// Meta reads 3xx pages' HTML bodies for a <meta http-equiv="refresh">, and flags one that points
+	// somewhere other than the Location header
+	Meta bool
+	// Peek makes only the first request: a redirect's target is recorded on the hop, but not fetched
+	Peek bool
+	// StopOnTracking ends the trace, without fetching it, at the first URL a redirect adds a tracking parameter to
+	StopOnTracking bool
+	// SameOrigin stops the trace at the first redirect that leaves the starting URL's scheme, host and port
+	SameOrigin bool
+	// MaxHops gives up with ErrTooManyRedirects once a chain has more hops than this (0 for no limit).
+	// Whatever it is, a chain whose hosts go round the same cycle cycleRepeats times gives up early, with ErrCyclicRedirect.
+	MaxHops int
+	// MaxHostChanges stops the trace, without fetching it, at the redirect that changes host for the
+	// (MaxHostChanges+1)th time (0 for no limit)
+	MaxHostChanges int
+	// MaxPerHost declares a loop once any one host has been visited more than this many times (0 for no limit)
+	MaxPerHost int
+	// Logger, if set, gets a structured event for each hop, redirect and error
+	Logger *slog.Logger
+	// OnHop, if set, is called with each hop once its notes are complete, before the next one is fetched
+	OnHop func(hop Hop)
+	// UserAgent replaces the default browser User-Agent
+	UserAgent string
+	// Headers are sent with every request, replacing any defaults of the same name
+	Headers http.Header
+	// HostHeaders maps a hostname to headers sent only to it, on top of Headers (see splitHostHeaders)
+	HostHeaders map[string]http.Header
+	// Credentials maps a hostname to the login sent to it as Basic Auth.
+	// They're only ever sent to their own host, never carried across a redirect.
+	Credentials map[string]Credential
+}
+
+// Credential is a username and password for one host
+type Credential struct {
+	Username string
+	Password string
+}
+
+// stringList is a flag.Value that collects repeated uses of a flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 type Hop struct {
-	Number     int
-	URL        string
-	StatusCode int
+	Number          int
+	URL             string
+	StatusCode      int
+	StatusCodeClass string     `json:",omitempty"`
+	IsRedirect      bool       // the chain went on from this hop to the next (or would have, with -peek)
+	IsFinal         bool       // this is the landing page; a trace that failed partway has none
+	Method          string     `json:",omitempty"`
+	Timestamp       *time.Time `json:",omitempty"`
+	DurationMs      float64    `json:",omitempty"`
+	Note            string     `json:",omitempty"`
+	Shortener       string     `json:",omitempty"`
+	Downgrade       bool       `json:",omitempty"`
+	Insecure        bool       `json:",omitempty"` // fetched over plain http, with -require-https
+	TimedOut        bool       `json:",omitempty"` // ran over -hop-timeout
+	// Roughly what the hop put on the wire, counted as HTTP/1.1 text: the request line, headers and body sent,
+	// and the status line, headers and whatever of the body was read
+	BytesSent       int64  `json:",omitempty"`
+	BytesReceived   int64  `json:",omitempty"`
+	Proto           string `json:",omitempty"`
+	ContentType     string `json:",omitempty"`
+	ContentLength   int64  `json:",omitempty"` // from the Content-Length header; -1 when the server didn't say
+	Server          string `json:",omitempty"` // the Server header: nginx, cloudflare, AkamaiGHost...
+	CDN             string `json:",omitempty"` // the CDN or WAF the response headers point to
+	TLSVersion      string `json:",omitempty"`
+	TLSCipher       string `json:",omitempty"`
+	UnexpectedType  bool   `json:",omitempty"`
+	UnexpectedFinal bool   `json:",omitempty"` // the landing URL isn't one -expect-final allows
+	Base64Target    string `json:",omitempty"` // a URL found base64-encoded in the Location's query (-b64-params)
+	TrackingParam   string `json:",omitempty"` // the parameter -stop-on-tracking stopped at
+
+	// With -meta, the target of a <meta http-equiv="refresh"> in the hop's body, and whether it disagrees
+	// with the hop's Location (a redirect that tells browsers and crawlers different things)
+	MetaRefresh  string `json:",omitempty"`
+	MetaMismatch bool   `json:",omitempty"`
+
+	// OpenRedirectSuspected is set when the hop sent the chain to another host named in its own query string
+	OpenRedirectSuspected bool `json:",omitempty"`
+
+	// With TraceOptions.Peek, where the hop would have redirected to (resolved against the hop's URL)
+	location string
+
+	// How much of the response body has been read so far, added into BytesReceived once the trace is done
+	bodyRead *int64
+
+	// On a 429, how long the server asked to wait before trying again (from Retry-After), for batch cooldowns
+	retryAfter time.Duration
+
+	// Kept only with TraceOptions.Capture, for -har. Unexported, so they stay out of -j and -template.
+	started        time.Time
+	requestHeader  http.Header
+	responseHeader http.Header
+	statusText     string
+}
+
+// addNote adds note to the hop's Note, after any note it already has
+func addNote(hop *Hop, note string) {
+	if hop.Note != "" {
+		note = hop.Note + "; " + note
+	}
+	hop.Note = note
+}
+
+// UAComparison is the result of -compare-ua: the same URL traced with two User-Agents
+type UAComparison struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Cloaking      bool      `json:"cloaking"`
+	Traces        []UATrace `json:"traces"`
+}
+
+type UATrace struct {
+	UserAgent string      `json:"userAgent"`
+	Result    TraceResult `json:"result"`
 }
 
 type TraceResult struct {
-	Hops     []Hop  `json:"hops"`
-	FinalURL string `json:"finalURL"`
-	CleanURL string `json:"cleanURL"`
+	SchemaVersion       int                 `json:"schemaVersion"`
+	OriginalURL         string              `json:"originalURL"`
+	Hops                []Hop               `json:"hops"`
+	FinalURL            string              `json:"finalURL"`
+	CleanURL            string              `json:"cleanURL"`
+	CanonicalURL        string              `json:"canonicalURL,omitempty"`
+	FinalQuery          map[string][]string `json:"finalQuery,omitempty"`
+	AddedParams         []string            `json:"addedParams,omitempty"`
+	ReturnsToStart      bool                `json:"returnsToStart,omitempty"`
+	WouldRedirectTo     string              `json:"wouldRedirectTo,omitempty"`
+	UniqueHosts         int                 `json:"uniqueHosts"`
+	Hosts               []string            `json:"hosts,omitempty"`
+	HostChanges         int                 `json:"hostChanges"`
+	StatusClasses       map[string]int      `json:"statusClasses,omitempty"` // hops per StatusCodeClass, like {"3xx": 8, "2xx": 1}
+	InsecureHopDetected bool                `json:"insecureHopDetected,omitempty"`
+	BytesSent           int64               `json:"bytesSent,omitempty"`
+	BytesReceived       int64               `json:"bytesReceived,omitempty"`
+	LongChain           bool                `json:"longChain"`
+	Cached              bool                `json:"cached,omitempty"`
+	UnexpectedType      bool                `json:"unexpectedType,omitempty"`
+	UnexpectedFinal     bool                `json:"unexpectedFinal,omitempty"`
+	Error               string              `json:"error,omitempty"`
 }
 
 // Utility Functions
-func ClearTerminal() {
+func ClearTerminal(w io.Writer) {
 	// For Unix-like systems, use ANSI escape codes
-	fmt.Print("\033[2J\033[H")
+	fmt.Fprint(w, "\033[2J\033[H")
 
 	// For Windows, use the "cls" command
 	if runtime.GOOS == "windows" {
 		cmd := exec.Command("cmd", "/c", "cls")
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = w
 		cmd.Run()
 	}
 }
 
-func createHTTPClient() *http.Client {
-	return &http.Client{
-		Timeout: 8 * time.Second,
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: 5 * time.Second,
+func createHTTPClient(opts ClientOptions) *http.Client {
+	dialer := &net.Dialer{}
+	if opts.LocalAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: opts.LocalAddr}
+	}
+
+	// Swap in the forced address, if any. The URL is untouched, so SNI and Host still use the original name.
+	resolveAddr := func(addr string) string {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if ip, ok := opts.Resolve[addr]; ok {
+				return net.JoinHostPort(ip, port)
+			}
+			if ip, ok := opts.Resolve[host]; ok {
+				return net.JoinHostPort(ip, port)
+			}
+		}
+		return addr
+	}
+
+	var tlsConfig *tls.Config
+	if opts.TLSMinVersion != 0 || len(opts.TLSCiphers) > 0 || opts.RootCAs != nil || len(opts.Certificates) > 0 {
+		tlsConfig = &tls.Config{
+			MinVersion:   opts.TLSMinVersion,
+			CipherSuites: opts.TLSCiphers,
+			RootCAs:      opts.RootCAs,
+			Certificates: opts.Certificates,
+		}
+	}
+
+	// With a DialContext of its own, the transport only tries HTTP/2 when told to
+	var transport http.RoundTripper = &http.Transport{
+		ResponseHeaderTimeout: 5 * time.Second,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		Proxy:                 proxyFor(opts.Proxies),
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		DisableKeepAlives:     opts.NoKeepAlive,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, resolveAddr(addr))
 		},
+	}
+	if opts.HTTP3 {
+		dialQUIC := quic.DialAddrEarly
+		// QUIC needs its own UDP socket bound to the source address; every connection shares it
+		if opts.LocalAddr != nil {
+			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: opts.LocalAddr})
+			dialQUIC = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+				if err != nil {
+					return nil, err
+				}
+				udpAddr, err := net.ResolveUDPAddr("udp", addr)
+				if err != nil {
+					return nil, err
+				}
+				return (&quic.Transport{Conn: udpConn}).DialEarly(ctx, udpAddr, tlsCfg, cfg)
+			}
+		}
+
+		transport = &http3Fallback{
+			h3: &http3.Transport{
+				// QUIC is always TLS 1.3, so only the trusted CAs and client certificates carry over
+				TLSClientConfig: &tls.Config{RootCAs: opts.RootCAs, Certificates: opts.Certificates},
+				QUICConfig:      &quic.Config{HandshakeIdleTimeout: 2 * time.Second},
+				Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+					return dialQUIC(ctx, resolveAddr(addr), tlsCfg, cfg)
+				},
+			},
+			fallback: transport,
+		}
+	}
+
+	return &http.Client{
+		Timeout:   8 * time.Second,
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// Stop following redirects after the first hop
 			if len(via) >= 1 {
@@ -83,6 +556,203 @@ func createHTTPClient() *http.Client {
 	}
 }
 
+// http3Fallback sends https requests over HTTP/3, and anything QUIC can't reach over TCP instead.
+// Hosts that fail once go straight to TCP for the rest of the run, so each only costs one handshake timeout.
+type http3Fallback struct {
+	h3       *http3.Transport
+	fallback http.RoundTripper
+	noH3     sync.Map
+}
+
+func (t *http3Fallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return t.fallback.RoundTrip(req)
+	}
+	if _, failed := t.noH3.Load(req.URL.Host); failed {
+		return t.fallback.RoundTrip(req)
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+	t.noH3.Store(req.URL.Host, true)
+
+	// The failed attempt may have read some of the body, so start the retry with a fresh one
+	if req.Body != nil && req.GetBody != nil {
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// parseHeaders turns "Name: value" entries into a header set
+func parseHeaders(entries []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, entry := range entries {
+		name, value, found := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q (expected \"Name: value\")", entry)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// parseTLSVersion maps -tls-min's "1.0" ... "1.3" to a crypto/tls version
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (expected 1.0, 1.1, 1.2 or 1.3)", version)
+}
+
+// parseTLSCiphers maps a comma-separated list of cipher suite names (as crypto/tls spells them) to their IDs.
+// Insecure suites are allowed, since checking whether a server still accepts them is the point.
+func parseTLSCiphers(names string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", strings.TrimSpace(name))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseResolve turns -resolve entries into a map for the dialer. An entry is host:ip, for every port,
+// or curl's host:port:ip, for just that port (keyed as host:port). An IPv6 address may be in brackets.
+func parseResolve(entries []string) (map[string]string, error) {
+	resolve := make(map[string]string)
+	for _, entry := range entries {
+		host, rest, found := strings.Cut(entry, ":")
+		if !found || host == "" {
+			return nil, fmt.Errorf("invalid -resolve entry %q (expected host:ip or host:port:ip)", entry)
+		}
+		key, ip := host, rest
+		if port, addr, found := strings.Cut(rest, ":"); found && port != "" && strings.Trim(port, "0123456789") == "" {
+			key, ip = net.JoinHostPort(host, port), addr
+		}
+		ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid IP address in -resolve entry %q", entry)
+		}
+		resolve[key] = ip
+	}
+	return resolve, nil
+}
+
+// proxySchemes are the proxy URL schemes the transport can use
+var proxySchemes = []string{"http", "https", "socks5", "socks5h"}
+
+// parseProxies checks the proxy URLs from -proxy and the config file's proxies table
+func parseProxies(entries map[string]string) (map[string]*url.URL, error) {
+	proxies := make(map[string]*url.URL)
+	for pattern, rawURL := range entries {
+		u, err := url.Parse(rawURL)
+		if err != nil || !slices.Contains(proxySchemes, strings.ToLower(u.Scheme)) || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q for %s (expected e.g. http://host:port or socks5://host:port)", rawURL, pattern)
+		}
+		proxies[strings.ToLower(pattern)] = u
+	}
+	return proxies, nil
+}
+
+// proxyFor returns the transport's Proxy func: an exact host match wins, then the longest matching
+// "*.suffix" pattern, then "default". No match (or no proxies at all) means a direct connection.
+func proxyFor(proxies map[string]*url.URL) func(*http.Request) (*url.URL, error) {
+	if len(proxies) == 0 {
+		return nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		host := strings.ToLower(req.URL.Hostname())
+		if proxy, ok := proxies[host]; ok {
+			return proxy, nil
+		}
+
+		var best *url.URL
+		bestLen := 0
+		for pattern, proxy := range proxies {
+			suffix, ok := strings.CutPrefix(pattern, "*")
+			if ok && strings.HasSuffix(host, suffix) && len(suffix) > bestLen {
+				best, bestLen = proxy, len(suffix)
+			}
+		}
+		if best != nil {
+			return best, nil
+		}
+		return proxies["default"], nil
+	}
+}
+
+// loadCACerts returns the system's trusted CAs plus those in the PEM file at path, for -cacert
+func loadCACerts(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// parseLocalAddr turns an -interface value (an IP address, or an interface name like eth0) into
+// the source address to send from, checking that it can actually be bound here
+func parseLocalAddr(value string) (net.IP, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		iface, err := net.InterfaceByName(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a network interface", value)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("reading addresses of %s: %w", value, err)
+		}
+		// Prefer IPv4, which more hosts answer on
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && (ip == nil || ipNet.IP.To4() != nil && ip.To4() == nil) {
+				ip = ipNet.IP
+			}
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("interface %s has no IP address", value)
+		}
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return nil, fmt.Errorf("can't send from %s: %w", ip, err)
+	}
+	listener.Close()
+	return ip, nil
+}
+
 // formatURL formats the URL for better presentation
 func formatURL(url string) string {
 	if len(url) <= outputWidth {
@@ -110,8 +780,8 @@ func formatURL(url string) string {
 	return formattedURL.String()
 }
 
-// loadConfig reads the configuration file and returns a Config struct
-// If the file doesn't exist or some values are missing, default values are used
+// loadConfig reads the configuration file (go-trace.toml, or failing that .yaml, .yml or .json) and returns a Config struct
+// If there's no file or some values are missing, default values are used
 func loadConfig() (*Config, error) {
 	// Check if XDG_CONFIG_HOME is set
 	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
@@ -128,23 +798,28 @@ func loadConfig() (*Config, error) {
 		configDir = filepath.Join(usr.HomeDir, ".config", "go-trace")
 	}
 
-	// Define config file path in the selected directory
-	configFilePath := filepath.Join(configDir, "go-trace.toml")
+	// Read the first config file there is in the selected directory
+	var config Config
+	found := false
+	for _, candidate := range configFiles {
+		configFilePath := filepath.Join(configDir, candidate.name)
+		file, err := os.ReadFile(configFilePath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
 
-	// Read the config file
-	file, err := os.ReadFile(configFilePath)
-	if os.IsNotExist(err) {
-		// go-trace.toml does not exist, return nil config (no error)
-		return nil, nil
-	} else if err != nil {
-		return nil, err
+		// Unmarshal its content into Config struct
+		if err := candidate.unmarshal(file, &config); err != nil {
+			return nil, fmt.Errorf("%s: %w", candidate.name, err)
+		}
+		found = true
+		break
 	}
-
-	// Unmarshal TOML content into Config struct
-	var config Config
-	err = toml.Unmarshal(file, &config)
-	if err != nil {
-		return nil, err
+	if !found {
+		// No config file, return nil config (no error)
+		return nil, nil
 	}
 
 	// Set default values if not present
@@ -157,403 +832,4132 @@ func loadConfig() (*Config, error) {
 	if !config.AlwaysVerbose {
 		config.AlwaysVerbose = false // Set the default value
 	}
-	if config.Width == 0 {
-		config.Width = 120 // Set the default value
-	}
+	// Width is left at 0 when unset, so the terminal's width can be used instead
 
 	return &config, nil
 }
 
-// Try to make a clean URL
-func makeCleanURL(url string) string {
-	return extractParameters(url)
-}
-
-func extractParameters(inputURL string) string {
-	var goodParams string
-	var additionalText string
-
-	// Parse the URL
-	parsedURL, err := url.Parse(inputURL)
-	if err != nil {
-		fmt.Println("Error parsing URL:", err)
-		return ""
+// applyProfile sets the flags in config's profile called name, except those given on the command line,
+// which win. A repeatable flag can be given a list of values.
+func applyProfile(config *Config, name string) error {
+	var profile map[string]any
+	if config != nil {
+		profile = config.Profiles[name]
 	}
-
-	// Add scheme and host
-	additionalText += parsedURL.Scheme + "://" + parsedURL.Host
-
-	// Add a trailing slash if there's a non-empty path
-	if parsedURL.Path != "" {
-		additionalText += "/"
+	if profile == nil {
+		var names []string
+		if config != nil {
+			names = slices.Sorted(maps.Keys(config.Profiles))
+		}
+		return fmt.Errorf("no profile %q in the config file (it has: %s)", name, cmp.Or(strings.Join(names, ", "), "none"))
 	}
 
-	// Extract query parameters
-	queryParams := parsedURL.Query()
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
 
-	// Iterate over the query parameters
-	for key, values := range queryParams {
-		if filterTheParams(key) {
-			// Add only good parameters and their values
-			for _, value := range values {
-				goodParams += "&" + key + "=" + value
-			}
+	for _, key := range slices.Sorted(maps.Keys(profile)) {
+		if flag.Lookup(key) == nil || key == "profile" {
+			return fmt.Errorf("profile %q: unknown flag %q", name, key)
+		}
+		if given[key] {
+			continue
 		}
-	}
 
-	// Add path segments
-	pathSegments := strings.Split(parsedURL.Path, "/")
-	for _, segment := range pathSegments {
-		if segment != "" && !strings.HasPrefix(segment, "#") {
-			// Check if the path already ends with a slash
-			if !strings.HasSuffix(additionalText, "/") {
-				additionalText += "/"
+		values, ok := profile[key].([]any)
+		if !ok {
+			values = []any{profile[key]}
+		}
+		for _, value := range values {
+			if err := flag.Set(key, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("profile %q: -%s: %w", name, key, err)
 			}
-			additionalText += segment
 		}
 	}
+	return nil
+}
 
-	// Add query parameters if present
-	if len(goodParams) > 1 {
-		additionalText += "?" + goodParams[1:]
-	}
+// cookieJar is an http.CookieJar that can be saved to and loaded from a Netscape-format cookie file
+// (the format curl and wget use). Unlike net/http/cookiejar it can list what it holds, which saving needs.
+// There's no public suffix list, so a site could set a cookie for a whole TLD; keep jars to traces you trust.
+type cookieJar struct {
+	mu      sync.Mutex
+	cookies []jarCookie
+}
 
-	// Add anchor if present
-	if parsedURL.Fragment != "" {
-		additionalText += "#" + parsedURL.Fragment
-	}
+type jarCookie struct {
+	Domain   string
+	HostOnly bool
+	Path     string
+	Secure   bool
+	Expires  time.Time // zero for session cookies
+	Name     string
+	Value    string
+}
 
-	return additionalText
+// domainMatch reports whether host is domain or one of its subdomains
+func domainMatch(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
 }
 
-func filterTheParams(param string) bool {
-	// List of known bad parts to discard
-	badParts := []string{
-		"_kx",
-		"bbeml",
-		"cid",
-		"ck_subscriber_id",
-		"cmpid",
-		"dm_i",
-		"dm_t",
-		"ea.tracking.id",
-		"EMLCID",
-		"EMLDTL",
-		"fbclid",
-		"gbraid",
-		"gclid",
-		"linkID",
-		"mailId",
-		"msclkid",
-		"mc_cid",
-		"mcID",
-		"mc_eid",
-		"mgparam",
-		"rfrr",
-		"ser",
-		"snr",
-		"wbraid",
-	}
+func (j *cookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
 
-	isBadPart := false
-	for _, part := range badParts {
-		if part == param || strings.HasPrefix(param, "cm_") || strings.HasPrefix(param, "pk_") || strings.HasPrefix(param, "utm_") {
-			isBadPart = true
-			break
+	host := strings.ToLower(u.Hostname())
+	for _, c := range cookies {
+		jc := jarCookie{Domain: host, HostOnly: true, Path: c.Path, Secure: c.Secure, Name: c.Name, Value: c.Value}
+		if c.Domain != "" {
+			domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+			if !domainMatch(host, domain) {
+				continue
+			}
+			jc.Domain, jc.HostOnly = domain, false
+		}
+		if jc.Path == "" || !strings.HasPrefix(jc.Path, "/") {
+			// Default to the directory of the request path
+			jc.Path = "/"
+			if i := strings.LastIndex(u.Path, "/"); i > 0 {
+				jc.Path = u.Path[:i]
+			}
+		}
+		switch {
+		case c.MaxAge < 0:
+			jc.Expires = time.Unix(1, 0)
+		case c.MaxAge > 0:
+			jc.Expires = time.Now().Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			jc.Expires = c.Expires
 		}
-	}
 
-	return !isBadPart
+		// A new cookie replaces any with the same name, domain and path; an expired one just deletes it
+		kept := j.cookies[:0]
+		for _, old := range j.cookies {
+			if old.Name != jc.Name || old.Domain != jc.Domain || old.Path != jc.Path {
+				kept = append(kept, old)
+			}
+		}
+		j.cookies = kept
+		if jc.Expires.IsZero() || jc.Expires.After(time.Now()) {
+			j.cookies = append(j.cookies, jc)
+		}
+	}
 }
 
-// Output as JSON
-func outputAsJSON(traceResult TraceResult) error {
-	// Marshal the TraceResult struct into a formatted JSON string
-	jsonString, err := json.MarshalIndent(traceResult, "", "  ")
-	if err != nil {
-		return err
+func (j *cookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	host := strings.ToLower(u.Hostname())
+	path := u.Path
+	if path == "" {
+		path = "/"
 	}
 
-	// Print the JSON string
-	fmt.Println(string(jsonString))
+	var cookies []*http.Cookie
+	for _, jc := range j.cookies {
+		if jc.HostOnly && host != jc.Domain || !jc.HostOnly && !domainMatch(host, jc.Domain) {
+			continue
+		}
+		if path != jc.Path && !strings.HasPrefix(path, strings.TrimSuffix(jc.Path, "/")+"/") {
+			continue
+		}
+		if jc.Secure && u.Scheme != "https" {
+			continue
+		}
+		if !jc.Expires.IsZero() && jc.Expires.Before(time.Now()) {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: jc.Name, Value: jc.Value})
+	}
+	return cookies
+}
+
+// loadCookieJar reads a Netscape-format cookie file. A missing file gives an empty jar, so the first run can create it.
+func loadCookieJar(path string) (*cookieJar, error) {
+	jar := &cookieJar{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return jar, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		// curl marks HttpOnly cookies with a prefix on an otherwise commented-out line
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 tab-separated fields, got %d", n+1, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", n+1, fields[4])
+		}
+
+		jc := jarCookie{
+			Domain:   strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			HostOnly: fields[1] != "TRUE",
+			Path:     fields[2],
+			Secure:   fields[3] == "TRUE",
+			Name:     fields[5],
+			Value:    fields[6],
+		}
+		if expires != 0 {
+			jc.Expires = time.Unix(expires, 0)
+			if jc.Expires.Before(time.Now()) {
+				continue
+			}
+		}
+		jar.cookies = append(jar.cookies, jc)
+	}
+
+	return jar, nil
+}
+
+// save writes the jar back out in Netscape format. Session cookies are kept (with an expiry of 0),
+// since carrying a login from one run to the next is the point.
+func (j *cookieJar) save(path string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var out strings.Builder
+	out.WriteString("# Netscape HTTP Cookie File\n# Written by go-trace\n\n")
+	for _, jc := range j.cookies {
+		domain, includeSubdomains := jc.Domain, "FALSE"
+		if !jc.HostOnly {
+			domain, includeSubdomains = "."+jc.Domain, "TRUE"
+		}
+		secure := "FALSE"
+		if jc.Secure {
+			secure = "TRUE"
+		}
+		var expires int64
+		if !jc.Expires.IsZero() {
+			expires = jc.Expires.Unix()
+		}
+		fmt.Fprintf(&out, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, includeSubdomains, jc.Path, secure, expires, jc.Name, jc.Value)
+	}
+
+	return os.WriteFile(path, []byte(out.String()), 0o600)
+}
+
+// loadNetrc reads machine credentials from $NETRC, or ~/.netrc (_netrc on Windows)
+func loadNetrc() (map[string]Credential, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+
+		name := ".netrc"
+		if runtime.GOOS == "windows" {
+			name = "_netrc"
+		}
+		path = filepath.Join(usr.HomeDir, name)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseNetrc(string(data)), nil
+}
+
+// parseUserFlag splits -u's user:password. With no password given, it's asked for (without echo) if stdin is a terminal.
+func parseUserFlag(value string) (Credential, error) {
+	username, password, found := strings.Cut(value, ":")
+	if found {
+		return Credential{Username: username, Password: password}, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return Credential{}, fmt.Errorf("no password given (expected user:password)")
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	entered, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return Credential{}, err
+	}
+	return Credential{Username: username, Password: string(entered)}, nil
+}
+
+// withStartingHosts adds cred for the host of each URL, taking precedence over netrc.
+// Like curl, -u goes only to where a trace starts, not to every host a chain wanders through.
+func withStartingHosts(creds map[string]Credential, cred Credential, urls ...string) map[string]Credential {
+	if creds == nil {
+		creds = make(map[string]Credential)
+	}
+	for _, u := range urls {
+		if host := strings.ToLower(hostOf(u)); host != "" {
+			creds[host] = cred
+		}
+	}
+	return creds
+}
+
+// startingHostHeaders are the -H headers that only make sense for (or should only be trusted to) the host a
+// trace starts at: a Host override would send a cross-host redirect to the wrong virtual host, and a login or
+// cookie shouldn't be handed to every third party a chain passes through
+var startingHostHeaders = []string{"Host", "Authorization", "Cookie"}
+
+// splitHostHeaders takes startingHostHeaders out of headers, and keys them by the host of each URL instead,
+// the way withStartingHosts does -u. The rest of headers still go with every request.
+func splitHostHeaders(headers http.Header, urls ...string) (http.Header, map[string]http.Header) {
+	scoped := make(http.Header)
+	for _, name := range startingHostHeaders {
+		if values, ok := headers[name]; ok {
+			scoped[name] = values
+		}
+	}
+	if len(scoped) == 0 {
+		return headers, nil
+	}
+
+	rest := headers.Clone()
+	for name := range scoped {
+		rest.Del(name)
+	}
+	byHost := make(map[string]http.Header)
+	for _, u := range urls {
+		if host := strings.ToLower(hostOf(u)); host != "" {
+			byHost[host] = scoped
+		}
+	}
+	return rest, byHost
+}
+
+// parseNetrc pulls machine/login/password entries out of a .netrc file
+// "default" entries are skipped on purpose: they'd match every host a chain passes through.
+func parseNetrc(data string) map[string]Credential {
+	creds := make(map[string]Credential)
+
+	var machine string
+	var cred Credential
+	flush := func() {
+		if machine != "" {
+			creds[machine] = cred
+		}
+		machine = ""
+		cred = Credential{}
+	}
+
+	inMacro := false
+	for _, line := range strings.Split(data, "\n") {
+		// Macro definitions run until the next blank line
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine":
+				flush()
+				if i+1 < len(fields) {
+					i++
+					machine = strings.ToLower(fields[i])
+				}
+			case "default":
+				flush()
+			case "login":
+				if i+1 < len(fields) {
+					i++
+					cred.Username = fields[i]
+				}
+			case "password":
+				if i+1 < len(fields) {
+					i++
+					cred.Password = fields[i]
+				}
+			case "account":
+				i++
+			case "macdef":
+				flush()
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	flush()
+
+	return creds
+}
+
+// redactURL masks the userinfo and the values of sensitive query parameters in rawURL, when -sanitize is on
+func redactURL(rawURL string) string {
+	if !sanitize {
+		return rawURL
+	}
+	return maskURL(rawURL)
+}
+
+// maskURL masks the userinfo and the values of sensitive query parameters in rawURL, whether or not -sanitize is on.
+// The query is rewritten piece by piece, so the other parameters keep their order and encoding.
+func maskURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	hadUser := u.User != nil
+	u.User = nil
+	if u.RawQuery != "" {
+		pairs := strings.Split(u.RawQuery, "&")
+		for i, pair := range pairs {
+			name, _, found := strings.Cut(pair, "=")
+			decoded, err := url.QueryUnescape(name)
+			if err != nil {
+				decoded = name
+			}
+			if found && sensitiveParams[strings.ToLower(decoded)] {
+				pairs[i] = name + "=***"
+			}
+		}
+		u.RawQuery = strings.Join(pairs, "&")
+	}
+
+	// url.User would percent-encode the asterisks, so the mask goes in by hand
+	if hadUser {
+		return strings.Replace(u.String(), "//", "//***@", 1)
+	}
+	return u.String()
+}
+
+// sanitizeResult masks every URL in result. Hops are copied first, since the caller may still hold the slice.
+func sanitizeResult(result *TraceResult) {
+	result.OriginalURL = redactURL(result.OriginalURL)
+	result.FinalURL = redactURL(result.FinalURL)
+	result.CleanURL = redactURL(result.CleanURL)
+	result.CanonicalURL = redactURL(result.CanonicalURL)
+
+	hops := make([]Hop, len(result.Hops))
+	for i, hop := range result.Hops {
+		hop.URL = redactURL(hop.URL)
+		hop.Base64Target = redactURL(hop.Base64Target)
+		hop.MetaRefresh = redactURL(hop.MetaRefresh)
+		hops[i] = hop
+	}
+	result.Hops = hops
+	result.Error = redactText(result.Error)
+
+	for name := range result.FinalQuery {
+		if sensitiveParams[strings.ToLower(name)] {
+			result.FinalQuery[name] = []string{"***"}
+		}
+	}
+}
+
+// urlInTextPattern finds URLs inside free text, such as an error message (url.Error quotes its URL)
+var urlInTextPattern = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s"'<>]+`)
+
+// redactText applies redactURL to every URL in text, for error messages that quote the URL they failed on
+func redactText(text string) string {
+	if !sanitize {
+		return text
+	}
+	return maskText(text)
+}
+
+// maskText applies maskURL to every URL in text, whether or not -sanitize is on
+func maskText(text string) string {
+	return urlInTextPattern.ReplaceAllStringFunc(text, maskURL)
+}
+
+// canonicalURL puts rawURL in a stable form for comparing and deduplicating:
+// lowercase scheme and host, no default port, no doubled slashes in the path, and sorted query parameters
+func canonicalURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || !isHTTPScheme(u.Scheme) {
+		return rawURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]" // IPv6
+	} else {
+		u.Host = host
+	}
+
+	for strings.Contains(u.Path, "//") {
+		u.Path = strings.ReplaceAll(u.Path, "//", "/")
+	}
+	u.RawPath = ""
+
+	// Encode sorts by key
+	if u.RawQuery != "" {
+		u.RawQuery = u.Query().Encode()
+	}
+
+	return u.String()
+}
+
+// Try to make a clean URL
+func makeCleanURL(rawURL string) string {
+	// Non-web URLs (app links, data: and so on) are left as they are
+	if u, err := url.Parse(rawURL); err == nil && !isHTTPScheme(u.Scheme) {
+		return rawURL
+	}
+
+	return extractParameters(rawURL)
+}
+
+// trimTrailingSlash drops trailing slashes from a web URL's path, so /docs/ and /docs compare equal.
+// A root path is left alone.
+func trimTrailingSlash(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || !isHTTPScheme(u.Scheme) {
+		return rawURL
+	}
+
+	trimmed := strings.TrimRight(u.Path, "/")
+	if trimmed == "" || trimmed == u.Path {
+		return rawURL
+	}
+	u.Path = trimmed
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u.String()
+}
+
+// normalizeURLEncoding percent-encodes a web URL one consistent way: every path segment, query name and value
+// and the fragment is decoded and then escaped again by net/url, so characters that needn't be escaped aren't,
+// reserved ones inside a value are, and escapes come out in uppercase. The query keeps its order.
+func normalizeURLEncoding(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || !isHTTPScheme(u.Scheme) {
+		return rawURL
+	}
+
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, segment := range segments {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segments[i] = url.PathEscape(decoded)
+		}
+	}
+	path := strings.Join(segments, "/")
+	if decoded, err := url.PathUnescape(path); err == nil {
+		u.Path, u.RawPath = decoded, path
+	}
+
+	if u.RawQuery != "" {
+		pairs := strings.Split(u.RawQuery, "&")
+		for i, pair := range pairs {
+			name, value, hasValue := strings.Cut(pair, "=")
+			if decoded, err := url.QueryUnescape(name); err == nil {
+				name = url.QueryEscape(decoded)
+			}
+			if decoded, err := url.QueryUnescape(value); err == nil {
+				value = url.QueryEscape(decoded)
+			}
+			pairs[i] = name
+			if hasValue {
+				pairs[i] += "=" + value
+			}
+		}
+		u.RawQuery = strings.Join(pairs, "&")
+	}
+
+	u.RawFragment = ""
+	return u.String()
+}
+
+// sortQueryParams puts a web URL's query parameters in alphabetical order (url.Values.Encode sorts by key),
+// so the same parameters in a different order come out as the same URL
+func sortQueryParams(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || !isHTTPScheme(u.Scheme) || u.RawQuery == "" {
+		return rawURL
+	}
+	u.RawQuery = u.Query().Encode()
+	return u.String()
+}
+
+// uriScheme returns the lowercased scheme of a URI, or "" if it doesn't start with one (a relative reference)
+func uriScheme(uri string) string {
+	for i, r := range uri {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.'):
+		case i > 0 && r == ':':
+			return strings.ToLower(uri[:i])
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// dataMediaType returns the media type declared by a data: URI, which defaults to text/plain
+func dataMediaType(uri string) string {
+	header, _, _ := strings.Cut(uri[len("data:"):], ",")
+	mediaType, _, _ := strings.Cut(header, ";")
+	if mediaType == "" {
+		return "text/plain"
+	}
+	return strings.ToLower(mediaType)
+}
+
+// originOf returns u's scheme://host:port, with the default port filled in so that :443 and no port compare equal
+func originOf(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// hostOf returns the hostname of rawURL, or "" if it can't be parsed
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// shortenerFor returns the name of the URL shortener at host, or "" if it isn't one
+func shortenerFor(host string) string {
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	return knownShorteners[host]
+}
+
+// isHTTPScheme reports whether scheme is one the tracer can follow
+func isHTTPScheme(scheme string) bool {
+	scheme = strings.ToLower(scheme)
+	return scheme == "http" || scheme == "https"
+}
+
+func extractParameters(inputURL string) string {
+	var goodParams string
+	var additionalText string
+
+	// Parse the URL
+	parsedURL, err := url.Parse(inputURL)
+	if err != nil {
+		fmt.Println("Error parsing URL:", err)
+		return ""
+	}
+
+	// Add scheme and host
+	additionalText += parsedURL.Scheme + "://" + parsedURL.Host
+
+	// Add a trailing slash if there's a non-empty path
+	if parsedURL.Path != "" {
+		additionalText += "/"
+	}
+
+	// Extract query parameters
+	queryParams := parsedURL.Query()
+
+	// Iterate over the query parameters
+	for key, values := range queryParams {
+		if filterTheParams(key) {
+			// Add only good parameters and their values
+			for _, value := range values {
+				goodParams += "&" + key + "=" + value
+			}
+		}
+	}
+
+	// Add path segments
+	pathSegments := strings.Split(parsedURL.Path, "/")
+	for _, segment := range pathSegments {
+		if segment != "" && !strings.HasPrefix(segment, "#") {
+			// Check if the path already ends with a slash
+			if !strings.HasSuffix(additionalText, "/") {
+				additionalText += "/"
+			}
+			additionalText += segment
+		}
+	}
+
+	// Add query parameters if present
+	if len(goodParams) > 1 {
+		additionalText += "?" + goodParams[1:]
+	}
+
+	// Add anchor if present
+	if parsedURL.Fragment != "" {
+		additionalText += "#" + parsedURL.Fragment
+	}
+
+	return additionalText
+}
+
+func filterTheParams(param string) bool {
+	// List of known bad parts to discard
+	badParts := []string{
+		"_kx",
+		"bbeml",
+		"cid",
+		"ck_subscriber_id",
+		"cmpid",
+		"dm_i",
+		"dm_t",
+		"ea.tracking.id",
+		"EMLCID",
+		"EMLDTL",
+		"fbclid",
+		"gbraid",
+		"gclid",
+		"linkID",
+		"mailId",
+		"msclkid",
+		"mc_cid",
+		"mcID",
+		"mc_eid",
+		"mgparam",
+		"rfrr",
+		"ser",
+		"snr",
+		"wbraid",
+	}
+
+	isBadPart := false
+	for _, part := range badParts {
+		if part == param || strings.HasPrefix(param, "cm_") || strings.HasPrefix(param, "pk_") || strings.HasPrefix(param, "utm_") {
+			isBadPart = true
+			break
+		}
+	}
+
+	return !isBadPart
+}
+
+// openRedirectParam returns the name of the query parameter of requestURL that names target's host,
+// when that's a different host from requestURL's own: the classic open redirect, where ?next=https://evil.example
+// sends visitors wherever the link says. Values are checked as given and once more unescaped, to catch double encoding.
+func openRedirectParam(requestURL *url.URL, target *url.URL) string {
+	targetHost := target.Hostname()
+	if targetHost == "" || strings.EqualFold(targetHost, requestURL.Hostname()) {
+		return ""
+	}
+
+	query := requestURL.Query()
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, value := range query[name] {
+			candidates := []string{value}
+			if unescaped, err := url.QueryUnescape(value); err == nil && unescaped != value {
+				candidates = append(candidates, unescaped)
+			}
+			for _, candidate := range candidates {
+				u, err := url.Parse(strings.TrimSpace(candidate))
+				if err == nil && strings.EqualFold(u.Hostname(), targetHost) {
+					return name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// addedTrackingParam returns the first (alphabetically) known tracking parameter in rawURL's query that
+// previousURL's doesn't have, or "": the tracking a redirect to rawURL brought in
+func addedTrackingParam(rawURL string, previousURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	var had url.Values
+	if previous, err := url.Parse(previousURL); err == nil {
+		had = previous.Query()
+	}
+	for _, name := range slices.Sorted(maps.Keys(u.Query())) {
+		if !filterTheParams(name) && !had.Has(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// saveCookieJar writes jar to path, if -cookie-jar was given. A failure is only a warning; the trace still stands.
+func saveCookieJar(jar *cookieJar, path string) {
+	if jar == nil {
+		return
+	}
+	if err := jar.save(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving cookie jar: %s\n", err)
+	}
+}
+
+// readURLList reads one URL per line from a file, or from stdin when path is "-"
+// Blank lines and lines starting with # are skipped
+func readURLList(path string) ([]string, error) {
+	var data []byte
+	var err error
+
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+
+	return urls, nil
+}
+
+// resolveAgainst resolves each of urls against base, so a path like /a/b becomes a full URL on base's host.
+// Full URLs are left as they are; a nil base leaves everything alone.
+func resolveAgainst(base *url.URL, urls []string) ([]string, error) {
+	if base == nil {
+		return urls, nil
+	}
+
+	resolved := make([]string, len(urls))
+	for i, rawURL := range urls {
+		ref, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", rawURL, err)
+		}
+		resolved[i] = base.ResolveReference(ref).String()
+	}
+	return resolved, nil
+}
+
+// readURLJSON reads a JSON array of URLs, or of objects with a "url" field, from a file (or stdin when path is "-")
+func readURLJSON(path string) ([]string, error) {
+	var data []byte
+	var err error
+
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, jsonPositionError(data, err)
+	}
+
+	urls := make([]string, 0, len(entries))
+	for i, entry := range entries {
+		var u string
+		if err := json.Unmarshal(entry, &u); err != nil {
+			var obj struct {
+				URL string `json:"url"`
+			}
+			if err := json.Unmarshal(entry, &obj); err != nil || obj.URL == "" {
+				return nil, fmt.Errorf("entry %d: expected a URL string or an object with a \"url\" field", i)
+			}
+			u = obj.URL
+		}
+		urls = append(urls, strings.TrimSpace(u))
+	}
+
+	return urls, nil
+}
+
+// jsonPositionError adds the line and column to a JSON syntax error, or to input that isn't an array
+func jsonPositionError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		// The decoder's wording names internal types, so say what was wanted instead
+		offset = typeErr.Offset
+		err = fmt.Errorf("expected a JSON array of URLs, found %s", typeErr.Value)
+	default:
+		return err
+	}
+
+	offset = min(offset, int64(len(data)))
+	before := data[:offset]
+	line := strings.Count(string(before), "\n") + 1
+	column := int(offset) - strings.LastIndex(string(before), "\n")
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// Output as JSON
+func outputAsJSON(traceResult any) error {
+	// Marshal the result(s) into a formatted JSON string, or a single line with -compact
+	var jsonString []byte
+	var err error
+	if compactJSON {
+		jsonString, err = json.Marshal(traceResult)
+	} else {
+		jsonString, err = json.MarshalIndent(traceResult, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Print the JSON string
+	fmt.Println(string(jsonString))
+
+	return nil
+}
+
+// commands are the subcommands go-trace accepts as its first argument
+var commands = []string{"trace", "batch", "version"}
+
+// splitCommand peels a subcommand off the front of args. Without one, the command is ""
+// and args are left alone, so "go-trace <url>" behaves the same as "go-trace trace <url>".
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 && slices.Contains(commands, args[0]) {
+		return args[0], args[1:]
+	}
+	return "", args
+}
+
+func printUsageMessage() {
+	fmt.Printf("\n%sUsage%s: go-trace [trace] [options] <URL>\n       go-trace [batch] [options] -f <file>\n       go-trace [batch] [options] -fj <file>\n       go-trace version\n\n"+
+		"\t%sOptions%s:\n"+
+		"\t-allow-downgrade-once: allows one https -> http redirect, but not at the landing page\n"+
+		"\t-arrow: prints the chain on one line, its URLs joined with \" -> \"\n"+
+		"\t-arrow-hosts: like -arrow, with just the hosts\n"+
+		"\t-b64-params: decodes these query params (comma-separated) as base64, following a URL found in one\n"+
+		"\t-base url: resolves the URL, or each one in the -f file, against this one, so they can be just paths (/a, /b/c)\n"+
+		"\t-browser: sends the full header set of a desktop browser (Accept, Sec-Fetch-* and so on), not just its User-Agent\n"+
+		"\t-bytes: shows roughly how many bytes each hop sent and received, and the total, in verbose output\n"+
+		"\t-cacert file: also trusts the CA certificates in this PEM file\n"+
+		"\t-canonical: also outputs a canonical form of the clean URL\n"+
+		"\t-cert file: presents this client certificate (PEM) to servers that require mutual TLS\n"+
+		"\t-compare-ua agent: traces a second time with this User-Agent and flags cloaking if the destinations differ\n"+
+		"\t-compact: outputs JSON on a single line, for logs (implies -j)\n"+
+		"\t-content-type: sets the Content-Type sent with -data (default: application/x-www-form-urlencoded)\n"+
+		"\t-cookie-jar: loads cookies from a Netscape-format file and saves them back after the trace\n"+
+		"\t-count: prints only the number of redirects\n"+
+		"\t-data: sends a body with the first request\n"+
+		"\t-dot: outputs the chain as a Graphviz DOT graph (pipe into dot -Tpng)\n"+
+		"\t-expect-final: flags a final URL that doesn't match this host or URL pattern (repeatable, * matches anything)\n"+
+		"\t-expect-type: flags a final response whose Content-Type isn't in this list (e.g. image/*,application/pdf)\n"+
+		"\t-fail-on-error: exits with status 1 when the final response isn't 2xx (or isn't an -expect-type or -expect-final, or -require-https fails)\n"+
+		"\t-f: reads URLs from a file, one per line (- for stdin)\n"+
+		"\t-fj: reads URLs from a JSON array of strings or {\"url\": ...} objects (- for stdin); implies -j\n"+
+		"\t-follow-codes: the redirect codes to follow (default: 301,302,303,307,308)\n"+
+		"\t-group-by-final: in batch mode, groups the results by the host they end at, with a count for each\n"+
+		"\t-H \"Name: value\": sends an extra header with every request (repeatable); Host, Authorization and Cookie only go to the starting host\n"+
+		"\t-h: prints this help message\n"+
+		"\t-har <file>: writes the trace as a HAR (HTTP Archive) file, - for stdout in place of the usual output\n"+
+		"\t-head-then-get: tries HEAD on each hop, falling back to GET when no Location comes back\n"+
+		"\t-hop N: prints only the URL of hop N (-1 is the last hop; add -v for its status too)\n"+
+		"\t-hop-timeout duration: caps each hop on its own; a hop that runs over after sending its Location is still followed\n"+
+		"\t-host-count: prints only the number of distinct hosts the chain passes through\n"+
+		"\t-http3: tries HTTP/3 (QUIC) first on https hops, falling back to TCP (HTTP/2 or 1.1, as without it)\n"+
+		"\t-i: shows each hop as it's fetched and waits for Enter before following the redirect\n"+
+		"\t-interface ip: sends requests from this local IP address or network interface\n"+
+		"\t-interesting: in verbose output, folds runs of unremarkable same-host redirects into one line\n"+
+		"\t-j: outputs as JSON\n"+
+		"\t-key file: the private key (PEM) for -cert, if it isn't in the same file\n"+
+		"\t-lang tag: sends Accept-Language: tag with every request (e.g. de-DE)\n"+
+		"\t-list-hops: prints each hop's URL on its own line, with nothing else\n"+
+		"\t-log-json: logs each hop, redirect and error to stderr as JSON lines\n"+
+		"\t-max-body N: reads at most N bytes of a response body (default: 10 MiB, 0 for no limit)\n"+
+		"\t-max-hops N: gives up with a \"too many redirects\" error after N hops (default: 20, 0 for no limit); chains going round the same hosts are stopped either way\n"+
+		"\t-max-host-changes N: stops at the redirect that would change host for the (N+1)th time\n"+
+		"\t-max-per-host N: declares a loop once any host is visited more than N times\n"+
+		"\t-max-total-bytes N: stops the trace once N body bytes have been read across all hops (0 for no limit)\n"+
+		"\t-meta: flags 3xx pages whose <meta http-equiv=\"refresh\"> points somewhere other than their Location\n"+
+		"\t-method: sets the HTTP method for the first request (default: GET, or POST with -data)\n"+
+		"\t-netrc: sends Basic Auth from ~/.netrc (or $NETRC) to matching hosts\n"+
+		"\t-no-body: closes every response without reading its body (saves bandwidth, but connections aren't reused)\n"+
+		"\t-no-cache: with -f, traces repeated URLs again instead of reusing the first result\n"+
+		"\t-no-color: turns off colors (so does setting NO_COLOR)\n"+
+		"\t-no-downgrade: aborts if a redirect goes from https to http\n"+
+		"\t-no-keepalive: uses a fresh connection for every request\n"+
+		"\t-no-unwrap: follows Location exactly, without unwrapping returnUri/redir params\n"+
+		"\t-normalize-encoding: percent-encodes the final and clean URLs one consistent way\n"+
+		"\t-otel: sends the trace as spans to the OpenTelemetry collector at OTEL_EXPORTER_OTLP_ENDPOINT\n"+
+		"\t-peek: makes only the first request, and shows where it would redirect to without going there\n"+
+		"\t-profile name: uses the flags set in this profile in the config file (flags given here still win)\n"+
+		"\t-proxy url: sends requests through this proxy (per-host proxies can be set in the config file)\n"+
+		"\t-quiet: hides the progress indicator in batch mode\n"+
+		"\t-record dir: saves each hop's request and response to dir, for -replay\n"+
+		"\t-replay dir: replays a trace from what -record saved in dir, without the network\n"+
+		"\t-require-https: flags any hop fetched over plain http (an error with -fail-on-error)\n"+
+		"\t-resolve host:ip: forces host to resolve to ip, or host:port:ip for one port (repeatable)\n"+
+		"\t-s: prints only the final/clean URL\n"+
+		"\t-same-origin: stops at the first redirect that leaves the starting scheme, host and port\n"+
+		"\t-sanitize: masks logins and sensitive query values (tokens, keys...) in the output\n"+
+		"\t-sort: orders batch results by input (default), hops (longest first), status or final URL\n"+
+		"\t-save-body file: writes the final response body to file (up to -max-body)\n"+
+		"\t-sort-query: sorts the query parameters left in the clean URL alphabetically\n"+
+		"\t-stop-on-tracking: stops at the first redirect that adds a tracking parameter, and names it\n"+
+		"\t-stream: prints each hop as soon as it's fetched, for live progress on slow chains\n"+
+		"\t-syslog addr: sends a summary of each trace to a syslog server (udp://host:514, tcp://host:601)\n"+
+		"\t-template: formats each result with a Go text/template (e.g. '{{.OriginalURL}} -> {{.FinalURL}}')\n"+
+		"\t-timestamps: records when each hop's request started\n"+
+		"\t-tls-ciphers: offers only these TLS 1.0-1.2 cipher suites (comma-separated Go names)\n"+
+		"\t-tls-min: the oldest TLS version to offer (1.0, 1.1, 1.2 or 1.3)\n"+
+		"\t-trace-to-stderr: prints the trace to stderr, and only the clean URL to stdout\n"+
+		"\t-trim-slash: drops a trailing slash from the clean URL's path (never the root /)\n"+
+		"\t-tsv: prints one tab-separated row per hop (number, status, class, url), for awk\n"+
+		"\t-tsv-header: like -tsv, with a header row first\n"+
+		"\t-u user:password: logs in to the starting URL's host (Basic, or Digest when challenged)\n"+
+		"\t-ua agent: sends this User-Agent instead of the default (a desktop Chrome)\n"+
+		"\t-url-deadline: caps the time spent tracing each URL (e.g. 3s)\n"+
+		"\t-v: shows all hops\n"+
+		"\t-warn-hops N: warns when a chain has more than N hops\n"+
+		"\t-w: sets the width of the URL tab (line wraps here)\n\n"+
+		"\t%sDefaults%s:\n"+
+		"\t-j: Off\n"+
+		"\t-v: Off (Final/Clean URL only)\n"+
+		"\t-w: terminal width, or 120 when not a terminal\n\n", underline, reset, underline, reset, underline, reset)
+}
+
+// printTraceResult prints result to w in the chosen view. The only error is a -template that fails to execute,
+// which has been reported on stderr by the time it's returned.
+func printTraceResult(w io.Writer, result TraceResult, viewOption string) error {
+	redirectURL := result.FinalURL
+	hops := result.Hops
+	cleanedURL := result.CleanURL
+
+	switch {
+	case viewOption == "template":
+		var out strings.Builder
+		if err := outputTemplate.Execute(&out, result); err != nil {
+			fmt.Fprintf(os.Stderr, "Error executing template: %s\n", err)
+			return err
+		}
+		fmt.Fprint(w, out.String())
+		if !strings.HasSuffix(out.String(), "\n") {
+			fmt.Fprintln(w)
+		}
+
+	case viewOption == "count":
+		fmt.Fprintln(w, redirectCount(hops))
+
+	case viewOption == "hostcount":
+		fmt.Fprintln(w, result.UniqueHosts)
+
+	case viewOption == "list":
+		for _, hop := range hops {
+			fmt.Fprintln(w, hop.URL)
+		}
+
+	case viewOption == "arrow":
+		fmt.Fprintln(w, arrowLine(hops))
+
+	case viewOption == "tsv":
+		for _, hop := range hops {
+			row := []string{strconv.Itoa(hop.Number), strconv.Itoa(hop.StatusCode), hop.StatusCodeClass, tsvField(hop.URL)}
+			if tsvSource {
+				row = append([]string{tsvField(result.OriginalURL)}, row...)
+			}
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+
+	case viewOption == "hop":
+		hop, ok := nthHop(hops, selectedHop)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: %s has no hop %d (the chain has %d)\n", result.OriginalURL, selectedHop, len(hops))
+		} else if hopWithStatus {
+			fmt.Fprintf(w, "%d %s\n", hop.StatusCode, hop.URL)
+		} else {
+			fmt.Fprintln(w, hop.URL)
+		}
+
+	case viewOption == "dot":
+		writeDOT(w, []TraceResult{result})
+
+	case viewOption == "terse":
+		fmt.Fprintln(w, resultURL(result))
+
+	case viewOption == "short" && redirectURL == "":
+		// Cut short before there was a final URL; the error that follows says why
+
+	case viewOption == "short":
+		// Print additional information
+		fmt.Fprintf(w, "\n%sFinal URL%s:     %s\n", boldBlue, reset, formatURL(redirectURL))
+
+		if cleanedURL != redirectURL {
+			fmt.Fprintf(w, "\n%sClean URL%s:     %s\n\n", green, reset, cleanedURL)
+		}
+
+		if result.CanonicalURL != "" {
+			if cleanedURL == redirectURL {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%sCanonical URL%s: %s\n\n", bold, reset, result.CanonicalURL)
+		}
+
+		if result.WouldRedirectTo != "" {
+			if cleanedURL == redirectURL && result.CanonicalURL == "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%sWould redirect to%s: %s\n\n", yellow, reset, formatURL(makeCleanURL(result.WouldRedirectTo)))
+		}
+
+		if result.ReturnsToStart {
+			if cleanedURL == redirectURL && result.CanonicalURL == "" {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%sNote%s: the chain ends back at the URL it started from\n\n", yellow, reset)
+		}
+
+	case viewOption == "verbose" && streamed:
+		// The hops are already on screen, under a divider sized before the chain's length was known
+		printTableFooter(w, result, strings.Repeat("-", outputDividerWidth))
+
+	case viewOption == "verbose":
+		divider := strings.Repeat("-", tableDividerWidth(hops, redirectURL, cleanedURL, result.CanonicalURL))
+
+		printTableHeader(w, divider)
+
+		// Print each hop, folding runs of unremarkable ones with -interesting
+		for i := 0; i < len(hops); i++ {
+			if !interestingOnly || interestingHop(hops, i) {
+				printHop(w, hops[i], divider)
+				continue
+			}
+
+			run := i
+			for run+1 < len(hops) && !interestingHop(hops, run+1) {
+				run++
+			}
+			if run == i {
+				printHop(w, hops[i], divider)
+				continue
+			}
+			fmt.Fprintf(w, "\n\t    |        | ... %d hops on %s ...\n", run-i+1, hostOf(hops[i].URL))
+			fmt.Fprintf(w, "\t%s\n", divider)
+			i = run
+		}
+
+		printTableFooter(w, result, divider)
+	}
+
+	if urlOut != nil && decoratedView(viewOption) {
+		fmt.Fprintln(urlOut, resultURL(result))
+	}
+	return nil
+}
+
+// printTableHeader prints the verbose table's column headings and the divider under them
+func printTableHeader(w io.Writer, divider string) {
+	fmt.Fprintf(w, "\n\t%sHop%s | %sStatus%s | %sURL%s\n", boldBlue, reset, boldBlue, reset, boldBlue, reset)
+	fmt.Fprintf(w, "\t%s", divider)
+}
+
+// printTableFooter prints what follows the hops in the verbose table: the final, clean and canonical URLs and any notes
+func printTableFooter(w io.Writer, result TraceResult, divider string) {
+	redirectURL := result.FinalURL
+	cleanedURL := result.CleanURL
+
+	// A chain cut short has no final URL, just the hops it got through
+	if redirectURL != "" {
+		fmt.Fprintf(w, "\n\t%sFinal URL%s:     %s\n", boldBlue, reset, formatURL(redirectURL))
+	}
+
+	if cleanedURL != redirectURL {
+		fmt.Fprintf(w, "\n\t%sClean URL%s:     %s\n", green, reset, cleanedURL)
+	}
+
+	if result.CanonicalURL != "" {
+		fmt.Fprintf(w, "\n\t%sCanonical URL%s: %s\n", bold, reset, result.CanonicalURL)
+	}
+
+	if len(result.AddedParams) > 0 {
+		fmt.Fprintf(w, "\n\t%sAdded params%s:  %s\n", yellow, reset, strings.Join(result.AddedParams, ", "))
+	}
+
+	if result.WouldRedirectTo != "" {
+		fmt.Fprintf(w, "\n\t%sWould redirect to%s: %s\n", yellow, reset, formatURL(makeCleanURL(result.WouldRedirectTo)))
+	}
+
+	if result.ReturnsToStart {
+		fmt.Fprintf(w, "\n\t%sNote%s: the chain ends back at the URL it started from\n", yellow, reset)
+	}
+
+	if shape := chainShape(result.Hops); shape != "" {
+		fmt.Fprintf(w, "\n\t%sChain%s:         %s\n", bold, reset, shape)
+	}
+
+	if showBytes {
+		fmt.Fprintf(w, "\n\t%sTransferred%s:   %s sent, %s received\n", bold, reset, formatSize(result.BytesSent), formatSize(result.BytesReceived))
+	}
+
+	fmt.Fprintf(w, "\t%s\n", divider)
+}
+
+// arrowLine joins a chain's hop URLs into one line, "a -> b -> c", for -arrow.
+// With -arrow-hosts it's their hosts instead, a host that redirects to itself counting once.
+func arrowLine(hops []Hop) string {
+	var steps []string
+	for _, hop := range hops {
+		step := hop.URL
+		if arrowHosts {
+			step = cmp.Or(hostOf(hop.URL), hop.URL)
+			if len(steps) > 0 && strings.EqualFold(steps[len(steps)-1], step) {
+				continue
+			}
+		}
+		steps = append(steps, step)
+	}
+	return strings.Join(steps, " -> ")
+}
+
+// tsvField keeps a value on one line and in one column by escaping tabs and line breaks the way a URL would
+func tsvField(value string) string {
+	return strings.NewReplacer("\t", "%09", "\n", "%0A", "\r", "%0D").Replace(value)
+}
+
+// tsvHeader is the -tsv-header row, matching the columns printTraceResult writes
+func tsvHeader() string {
+	header := "number\tstatus\tclass\turl"
+	if tsvSource {
+		header = "source\t" + header
+	}
+	return header
+}
+
+// nthHop picks hop n of a chain, counting from 1, or from the end when n is negative (-1 is the last hop)
+func nthHop(hops []Hop, n int) (Hop, bool) {
+	if n < 0 {
+		n += len(hops) + 1
+	}
+	if n < 1 || n > len(hops) {
+		return Hop{}, false
+	}
+	return hops[n-1], true
+}
+
+// resultURL is the one URL that stands for a result in -s output: the canonical URL if there is one,
+// otherwise the clean URL
+func resultURL(result TraceResult) string {
+	// With -peek, the answer is where the link points
+	if result.WouldRedirectTo != "" {
+		return makeCleanURL(result.WouldRedirectTo)
+	}
+	if result.CanonicalURL != "" {
+		return result.CanonicalURL
+	}
+	return cmp.Or(result.CleanURL, result.FinalURL)
+}
+
+// interestingHop reports whether hops[i] is worth showing with -interesting: the first and last hops,
+// anything that isn't a plain redirect, and hops that change host or scheme or pick up new tracking parameters
+func interestingHop(hops []Hop, i int) bool {
+	hop := hops[i]
+	if i == 0 || i == len(hops)-1 || hop.StatusCodeClass != "3xx" || len(hopDetails(hop)) > 0 {
+		return true
+	}
+
+	prev, err := url.Parse(hops[i-1].URL)
+	if err != nil {
+		return true
+	}
+	cur, err := url.Parse(hop.URL)
+	if err != nil {
+		return true
+	}
+	if !strings.EqualFold(prev.Hostname(), cur.Hostname()) || !strings.EqualFold(prev.Scheme, cur.Scheme) {
+		return true
+	}
+
+	// Tracking parameters that are just carried along from hop to hop aren't news
+	prevQuery := prev.Query()
+	for key := range cur.Query() {
+		if !filterTheParams(key) && !prevQuery.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// printHop prints one row of the verbose table, followed by divider
+func printHop(w io.Writer, hop Hop, divider string) {
+	fmt.Fprintf(
+		w,
+		"\n\t%s%-3d%s | %s%-6d%s | %s\n",
+		brightCyan,
+		hop.Number,
+		reset,
+		statusColor(hop),
+		hop.StatusCode,
+		reset,
+		formatURL(hop.URL),
+	)
+	for _, detail := range hopDetails(hop) {
+		fmt.Fprintf(w, "\t    |        | %s\n", detail)
+	}
+	// Who served the hop, and how big it was, are shown, but aren't details that make a hop stand out for -interesting
+	var extras []string
+	if hop.Server != "" {
+		extras = append(extras, "server: "+hop.Server)
+	}
+	if hop.CDN != "" && !strings.EqualFold(hop.CDN, hop.Server) {
+		extras = append(extras, "CDN: "+hop.CDN)
+	}
+	if hop.ContentLength > 0 {
+		extras = append(extras, formatSize(hop.ContentLength)+" body")
+	}
+	if showBytes && (hop.BytesSent > 0 || hop.BytesReceived > 0) {
+		extras = append(extras, fmt.Sprintf("%s sent, %s received", formatSize(hop.BytesSent), formatSize(hop.BytesReceived)))
+	}
+	if len(extras) > 0 {
+		fmt.Fprintf(w, "\t    |        | %s\n", strings.Join(extras, ", "))
+	}
+	fmt.Fprintf(w, "\t%s\n", divider)
+}
+
+// formatSize formats a byte count for people: 512 B, 14.2 KB, 3.1 MB
+func formatSize(n int64) string {
+	switch {
+	case n < 1000:
+		return fmt.Sprintf("%d B", n)
+	case n < 1000*1000:
+		return fmt.Sprintf("%.1f KB", float64(n)/1000)
+	}
+	return fmt.Sprintf("%.1f MB", float64(n)/(1000*1000))
+}
+
+// stepThroughHops returns an OnHop callback for -i: it shows each hop as it's fetched,
+// then waits for Enter before the next redirect is followed (or until ctx is cancelled)
+func stepThroughHops(ctx context.Context, w io.Writer) func(Hop) {
+	input := bufio.NewReader(os.Stdin)
+
+	return func(hop Hop) {
+		hop.URL = redactURL(hop.URL)
+		printHop(w, hop, strings.Repeat("-", tableDividerWidth([]Hop{hop}, hop.URL)))
+		if !hop.IsRedirect {
+			return
+		}
+
+		fmt.Fprint(w, "\tPress Enter to follow the redirect...")
+		pressed := make(chan struct{})
+		go func() {
+			input.ReadString('\n')
+			close(pressed)
+		}()
+
+		select {
+		case <-pressed:
+		case <-ctx.Done():
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// streamHops returns an OnHop callback for -stream: it prints each hop as a row of the verbose table as soon as
+// it's fetched, so a slow chain shows progress. The divider is the widest one, since the chain isn't known yet
+func streamHops(w io.Writer) func(Hop) {
+	divider := strings.Repeat("-", outputDividerWidth)
+	started := false
+
+	return func(hop Hop) {
+		if !started {
+			printTableHeader(w, divider)
+			started = true
+			streamed = true
+		}
+		hop.URL = redactURL(hop.URL)
+		printHop(w, hop, divider)
+	}
+}
+
+// hopDetails returns the extra lines shown under a hop in verbose mode
+func hopDetails(hop Hop) []string {
+	var details []string
+
+	if hop.Shortener != "" {
+		details = append(details, "shortener: "+hop.Shortener)
+	}
+	if hop.Timestamp != nil {
+		details = append(details, fmt.Sprintf("at %s (%.1f ms)", hop.Timestamp.Format("2006-01-02T15:04:05.000Z07:00"), hop.DurationMs))
+	}
+	if hop.Method != "" && hop.Method != "GET" {
+		details = append(details, "method: "+hop.Method)
+	}
+	if hop.Downgrade {
+		details = append(details, "downgraded to http")
+	}
+	if hop.Insecure && !hop.Downgrade {
+		details = append(details, "plain http")
+	}
+	if hop.TimedOut && hop.StatusCode != 0 {
+		details = append(details, "ran over the hop timeout (its Location was followed)")
+	}
+	if hop.MetaMismatch {
+		details = append(details, "meta refresh disagrees with Location: "+hop.MetaRefresh)
+	}
+	if hop.OpenRedirectSuspected {
+		details = append(details, "possible open redirect (the target host came from the query string)")
+	}
+	if showTLS && hop.TLSVersion != "" {
+		details = append(details, hop.TLSVersion+", "+hop.TLSCipher)
+	}
+	if hop.UnexpectedType {
+		details = append(details, fmt.Sprintf("unexpected content type: %q", hop.ContentType))
+	}
+	if hop.UnexpectedFinal {
+		details = append(details, "not an expected final destination")
+	}
+	if hop.Base64Target != "" {
+		details = append(details, "base64-encoded target: "+formatURL(hop.Base64Target))
+	}
+	if hop.Proto != "" && !strings.HasPrefix(hop.Proto, "HTTP/1.") {
+		details = append(details, "protocol: "+hop.Proto)
+	}
+	if hop.Note != "" {
+		details = append(details, hop.Note)
+	}
+
+	return details
+}
+
+// tableDividerWidth fits the verbose divider to the longest line in the table
+// URLs wrap at outputWidth, so the divider never grows past outputDividerWidth.
+func tableDividerWidth(hops []Hop, urls ...string) int {
+	longest := 0
+	for _, u := range urls {
+		longest = max(longest, len(u))
+	}
+	for _, hop := range hops {
+		longest = max(longest, len(hop.URL))
+		for _, detail := range hopDetails(hop) {
+			longest = max(longest, len(detail))
+		}
+	}
+
+	// Every line starts with a 15 character "Hop | Status | " or "Final URL:     " column
+	return min(longest+15, outputDividerWidth)
+}
+
+// statusColor picks the color for a hop's status code, by its class
+func statusColor(hop Hop) string {
+	if hop.StatusCode == http.StatusLoopDetected {
+		return magenta
+	}
+
+	switch hop.StatusCodeClass {
+	case "2xx":
+		return green
+	case "3xx":
+		return brightCyan
+	case "4xx":
+		return yellow
+	case "5xx":
+		return red
+	}
+	return ""
+}
+
+// disableColors turns off all terminal colors and styling
+func disableColors() {
+	bold, boldBlue, brightCyan, green, magenta, red, reset, underline, yellow = "", "", "", "", "", "", "", "", ""
+}
+
+// writeDOT writes the chains in results as a single Graphviz digraph. Each URL is one node, so
+// chains that pass through or land on the same URL share it; edges are labelled with the status code
+func writeDOT(w io.Writer, results []TraceResult) {
+	fmt.Fprintln(w, "digraph redirects {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintln(w, "\tnode [shape=box];")
+
+	seenNodes := map[string]bool{}
+	seenEdges := map[string]bool{}
+	for _, result := range results {
+		for i, hop := range result.Hops {
+			if !seenNodes[hop.URL] {
+				seenNodes[hop.URL] = true
+				// Graphviz uses the node name as its label, so only the landing page needs attributes
+				attrs := ""
+				if i == len(result.Hops)-1 {
+					attrs = fmt.Sprintf(" [xlabel=\"%d\", peripheries=2]", hop.StatusCode)
+				}
+				fmt.Fprintf(w, "\t%s%s;\n", dotID(hop.URL), attrs)
+			}
+			if i == 0 {
+				continue
+			}
+
+			from := result.Hops[i-1]
+			edge := fmt.Sprintf("%s -> %s [label=\"%d\"];", dotID(from.URL), dotID(hop.URL), from.StatusCode)
+			if !seenEdges[edge] {
+				seenEdges[edge] = true
+				fmt.Fprintf(w, "\t%s\n", edge)
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "}")
+}
+
+// dotID quotes s as a DOT ID. DOT strings only escape quotes (and backslashes, which Graphviz reads as escapes
+// in labels); anything else, UTF-8 included, goes in as is, where Go's %q would escape it.
+func dotID(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/), just the parts a redirect trace can fill in
+type harLog struct {
+	Log struct {
+		Version string     `json:"version"`
+		Creator harCreator `json:"creator"`
+		Pages   []harPage  `json:"pages"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harPage struct {
+	StartedDateTime time.Time         `json:"startedDateTime"`
+	ID              string            `json:"id"`
+	Title           string            `json:"title"`
+	PageTimings     map[string]string `json:"pageTimings"`
+}
+
+type harEntry struct {
+	PageRef         string         `json:"pageref"`
+	StartedDateTime time.Time      `json:"startedDateTime"`
+	Time            float64        `json:"time"`
+	Request         harRequest     `json:"request"`
+	Response        harResponse    `json:"response"`
+	Cache           map[string]any `json:"cache"`
+	Timings         harTimings     `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string  `json:"method"`
+	URL         string  `json:"url"`
+	HTTPVersion string  `json:"httpVersion"`
+	Cookies     []harNV `json:"cookies"`
+	Headers     []harNV `json:"headers"`
+	QueryString []harNV `json:"queryString"`
+	HeadersSize int     `json:"headersSize"`
+	BodySize    int     `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNV    `json:"cookies"`
+	Headers     []harNV    `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int        `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harNV struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// maskSecretHeaders returns a copy of header with the values of harSecretHeaders masked
+func maskSecretHeaders(header http.Header) http.Header {
+	masked := header.Clone()
+	for name, values := range masked {
+		if harSecretHeaders[name] {
+			masked[name] = slices.Repeat([]string{"***"}, len(values))
+		}
+	}
+	return masked
+}
+
+// harHeaders flattens a header set into HAR's name/value list, sorted so the output is stable.
+// Credentials and cookies are always masked, since HAR files get shared; with -sanitize, URLs in other headers are too.
+func harHeaders(header http.Header) []harNV {
+	list := []harNV{}
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		for _, value := range header[name] {
+			if harSecretHeaders[name] {
+				value = "***"
+			} else {
+				value = redactText(value)
+			}
+			list = append(list, harNV{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+// harSecretHeaders are masked in a HAR and in recorded fixtures (keys in canonical form)
+var harSecretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// newHAR builds a HAR log with a page per result and an entry per hop that made a request.
+// Synthetic hops (a loop, a non-web target, a timed-out fetch) have nothing to show, so they're left out.
+func newHAR(results []TraceResult) harLog {
+	var har harLog
+	har.Log.Version = "1.2"
+	har.Log.Creator = harCreator{Name: "go-trace", Version: buildVersion()}
+	har.Log.Pages = []harPage{}
+	har.Log.Entries = []harEntry{}
+
+	for i, result := range results {
+		pageID := fmt.Sprintf("page_%d", i+1)
+		pageAdded := false
+
+		for _, hop := range result.Hops {
+			if hop.started.IsZero() {
+				continue
+			}
+			if !pageAdded {
+				har.Log.Pages = append(har.Log.Pages, harPage{
+					StartedDateTime: hop.started,
+					ID:              pageID,
+					Title:           redactURL(result.OriginalURL),
+					PageTimings:     map[string]string{},
+				})
+				pageAdded = true
+			}
+
+			hopURL := redactURL(hop.URL)
+			query := []harNV{}
+			if u, err := url.Parse(hopURL); err == nil {
+				for _, name := range slices.Sorted(maps.Keys(u.Query())) {
+					for _, value := range u.Query()[name] {
+						query = append(query, harNV{Name: name, Value: value})
+					}
+				}
+			}
+
+			har.Log.Entries = append(har.Log.Entries, harEntry{
+				PageRef:         pageID,
+				StartedDateTime: hop.started,
+				Time:            hop.DurationMs,
+				Request: harRequest{
+					Method:      cmp.Or(hop.Method, "GET"),
+					URL:         hopURL,
+					HTTPVersion: hop.Proto,
+					Cookies:     []harNV{},
+					Headers:     harHeaders(hop.requestHeader),
+					QueryString: query,
+					HeadersSize: -1,
+					BodySize:    -1,
+				},
+				Response: harResponse{
+					Status:      hop.StatusCode,
+					StatusText:  strings.TrimSpace(strings.TrimPrefix(hop.statusText, strconv.Itoa(hop.StatusCode))),
+					HTTPVersion: hop.Proto,
+					Cookies:     []harNV{},
+					Headers:     harHeaders(hop.responseHeader),
+					Content:     harContent{Size: -1, MimeType: hop.responseHeader.Get("Content-Type")},
+					RedirectURL: redactURL(hop.responseHeader.Get("Location")),
+					HeadersSize: -1,
+					BodySize:    -1,
+				},
+				Cache: map[string]any{},
+				// Only the time to response headers is measured, so it all counts as waiting
+				Timings: harTimings{Wait: hop.DurationMs},
+			})
+		}
+	}
+
+	return har
+}
+
+// writeHAR writes results as a HAR file at path, or to stdout for "-"
+func writeHAR(path string, results []TraceResult) error {
+	data, err := json.MarshalIndent(newHAR(results), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// buildVersion returns the module version go-trace was built as, if Go recorded one
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// OTLP/JSON (https://opentelemetry.io/docs/specs/otlp/), enough of it to send one span per trace and one per hop
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// OTLP span kinds and status codes
+const (
+	otlpKindInternal = 1
+	otlpKindClient   = 3
+	otlpStatusError  = 2
+)
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]any{"stringValue": value}}
+}
+
+// OTLP/JSON carries 64-bit integers as strings
+func otlpInt(key string, value int) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]any{"intValue": strconv.Itoa(value)}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpID returns n random bytes, hex-encoded, for a trace or span ID
+func otlpID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// newOTLPExport turns each result into a trace: a parent span covering the whole chain,
+// with a child span per hop that made a request (synthetic hops have no timing to report).
+// The spans leave the machine, so URLs are masked even without -sanitize.
+func newOTLPExport(results []TraceResult) otlpExport {
+	var scope otlpScopeSpans
+	scope.Scope.Name = "go-trace"
+	scope.Scope.Version = buildVersion()
+	scope.Spans = []otlpSpan{}
+
+	for _, result := range results {
+		traceID := otlpID(16)
+		parent := otlpSpan{
+			TraceID: traceID,
+			SpanID:  otlpID(8),
+			Name:    "trace " + hostOf(result.OriginalURL),
+			Kind:    otlpKindInternal,
+			Attributes: []otlpAttribute{
+				otlpString("url.full", maskURL(result.OriginalURL)),
+				otlpString("go_trace.final_url", maskURL(result.FinalURL)),
+				otlpInt("go_trace.hops", len(result.Hops)),
+			},
+		}
+		if result.Error != "" {
+			parent.Status.Code = otlpStatusError
+			parent.Attributes = append(parent.Attributes, otlpString("error.type", maskText(result.Error)))
+		}
+
+		var start, end time.Time
+		var children []otlpSpan
+		for _, hop := range result.Hops {
+			if hop.started.IsZero() {
+				continue
+			}
+			hopEnd := hop.started.Add(time.Duration(hop.DurationMs * float64(time.Millisecond)))
+			if start.IsZero() {
+				start = hop.started
+			}
+			end = hopEnd
+
+			child := otlpSpan{
+				TraceID:           traceID,
+				SpanID:            otlpID(8),
+				ParentSpanID:      parent.SpanID,
+				Name:              cmp.Or(hop.Method, "GET"),
+				Kind:              otlpKindClient,
+				StartTimeUnixNano: otlpTime(hop.started),
+				EndTimeUnixNano:   otlpTime(hopEnd),
+				Attributes: []otlpAttribute{
+					otlpString("url.full", maskURL(hop.URL)),
+					otlpString("server.address", hostOf(hop.URL)),
+					otlpString("http.request.method", cmp.Or(hop.Method, "GET")),
+					otlpInt("http.response.status_code", hop.StatusCode),
+					otlpInt("go_trace.hop", hop.Number),
+				},
+			}
+			if hop.StatusCode >= 400 {
+				child.Status.Code = otlpStatusError
+			}
+			children = append(children, child)
+		}
+		if start.IsZero() {
+			// Nothing was fetched, so there's no chain to time
+			start, end = time.Now(), time.Now()
+		}
+		parent.StartTimeUnixNano = otlpTime(start)
+		parent.EndTimeUnixNano = otlpTime(end)
+
+		scope.Spans = append(scope.Spans, parent)
+		scope.Spans = append(scope.Spans, children...)
+	}
+
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = []otlpAttribute{otlpString("service.name", cmp.Or(os.Getenv("OTEL_SERVICE_NAME"), "go-trace"))}
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+// otlpTracesEndpoint is where spans are sent, following the OpenTelemetry exporter variables:
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT as given, or OTEL_EXPORTER_OTLP_ENDPOINT plus /v1/traces
+func otlpTracesEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	base := cmp.Or(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "http://localhost:4318")
+	return strings.TrimSuffix(base, "/") + "/v1/traces"
+}
+
+// exportOTLP sends results to the OpenTelemetry collector as OTLP/JSON over HTTP.
+// It uses its own client, so -resolve, -interface and the like only apply to the traced URLs.
+func exportOTLP(results []TraceResult) error {
+	data, err := json.Marshal(newOTLPExport(results))
+	if err != nil {
+		return err
+	}
+
+	exportClient := &http.Client{Timeout: 10 * time.Second}
+	resp, err := exportClient.Post(otlpTracesEndpoint(), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// syslogAddress splits a -syslog address into a network and host:port: "udp://host:514", "tcp://host:601",
+// or a bare "host:port", which is UDP. The port defaults to 514.
+func syslogAddress(addr string) (string, string, error) {
+	network := "udp"
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		network, addr = strings.ToLower(scheme), rest
+	}
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("unsupported syslog protocol %q (use udp or tcp)", network)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "514")
+	}
+	return network, addr, nil
+}
+
+// syslogParam escapes a structured data value as RFC 5424 requires
+var syslogParam = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogMessage formats result as an RFC 5424 message: a one-line summary, with the same facts as structured data.
+// Failed traces are logged as warnings, the rest as info, under the user facility.
+func syslogMessage(result TraceResult, hostname string, now time.Time) string {
+	status := 0
+	if len(result.Hops) > 0 {
+		status = result.Hops[len(result.Hops)-1].StatusCode
+	}
+	priority := 1*8 + 6
+	if result.Error != "" {
+		priority = 1*8 + 4
+	}
+
+	data := fmt.Sprintf(`[trace@32473 original="%s" final="%s" hops="%d" status="%d"`,
+		syslogParam.Replace(result.OriginalURL), syslogParam.Replace(result.FinalURL), len(result.Hops), status)
+	if result.Error != "" {
+		data += fmt.Sprintf(` error="%s"`, syslogParam.Replace(result.Error))
+	}
+	data += "]"
+
+	summary := fmt.Sprintf("%s -> %s (%d hops, status %d)", result.OriginalURL, result.FinalURL, len(result.Hops), status)
+	return fmt.Sprintf("<%d>1 %s %s go-trace %d trace %s %s",
+		priority, now.Format(time.RFC3339Nano), cmp.Or(hostname, "-"), os.Getpid(), data, summary)
+}
+
+// sendSyslog sends a message per result to the syslog server at addr. Over TCP, messages are framed
+// by octet counting (RFC 6587); over UDP, each is its own datagram.
+func sendSyslog(addr string, results []TraceResult) error {
+	network, hostPort, err := syslogAddress(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout(network, hostPort, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	hostname, _ := os.Hostname()
+	for _, result := range results {
+		message := syslogMessage(result, hostname, time.Now())
+		if network == "tcp" {
+			message = fmt.Sprintf("%d %s", len(message), message)
+		}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decoratedView reports whether viewOption is one of the human-oriented views (clears the screen, uses headings)
+func decoratedView(viewOption string) bool {
+	return viewOption == "short" || viewOption == "verbose"
+}
+
+// statusClass names the class of an HTTP status code, like "3xx" ("" when there was no response)
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return ""
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// statusClassCounts tallies a chain's hops by StatusCodeClass. Hops that got no response aren't counted.
+func statusClassCounts(hops []Hop) map[string]int {
+	var counts map[string]int
+	for _, hop := range hops {
+		if hop.StatusCodeClass == "" {
+			continue
+		}
+		if counts == nil {
+			counts = make(map[string]int)
+		}
+		counts[hop.StatusCodeClass]++
+	}
+	return counts
+}
+
+// chainShape sums up a chain's statuses in a line, like "8 redirects, 1 server error along the way, ended 200"
+func chainShape(hops []Hop) string {
+	if len(hops) == 0 {
+		return ""
+	}
+	// A chain cut short (or peeked at) never got to a landing page: its last hop is one more redirect
+	last := hops[len(hops)-1]
+	cut := (last.IsRedirect || !last.IsFinal) && last.StatusCode > 0
+	counts := statusClassCounts(hops[:len(hops)-1])
+	if cut {
+		counts = statusClassCounts(hops)
+	}
+
+	var parts []string
+	for _, class := range []struct{ key, noun string }{
+		{"3xx", "redirect"},
+		{"4xx", "client error"},
+		{"5xx", "server error"},
+	} {
+		n := counts[class.key]
+		switch {
+		case n == 1:
+			parts = append(parts, "1 "+class.noun)
+		case n > 1:
+			parts = append(parts, fmt.Sprintf("%d %ss", n, class.noun))
+		}
+	}
+	if counts["4xx"]+counts["5xx"] > 0 {
+		parts[len(parts)-1] += " along the way"
+	}
+
+	switch {
+	case cut:
+		parts = append(parts, "cut short")
+	case last.StatusCode > 0:
+		parts = append(parts, fmt.Sprintf("ended %d", last.StatusCode))
+	default:
+		parts = append(parts, "ended without a response")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// redirectCount is the number of redirects in a chain, not counting the landing page
+func redirectCount(hops []Hop) int {
+	return max(len(hops)-1, 0)
+}
+
+// Tracer Functions
+
+// detectCDN names the CDN or WAF that a response's headers point to, or returns "" if there's no sign of one
+func detectCDN(header http.Header) string {
+	server := strings.ToLower(header.Get("Server"))
+	via := strings.ToLower(header.Get("Via"))
+	cookies := strings.ToLower(strings.Join(header.Values("Set-Cookie"), ";"))
+
+	switch {
+	case strings.Contains(server, "cloudflare") || header.Get("CF-Ray") != "":
+		return "Cloudflare"
+	case strings.Contains(server, "akamai") || header.Get("Akamai-GRN") != "" || header.Get("X-Akamai-Transformed") != "":
+		return "Akamai"
+	case header.Get("X-Fastly-Request-ID") != "" || (strings.HasPrefix(header.Get("X-Served-By"), "cache-") && header.Get("X-Timer") != ""):
+		return "Fastly"
+	case strings.Contains(server, "sucuri") || header.Get("X-Sucuri-ID") != "":
+		return "Sucuri"
+	case header.Get("X-Iinfo") != "" || strings.Contains(cookies, "incap_ses_") || strings.Contains(strings.ToLower(header.Get("X-CDN")), "imperva"):
+		return "Imperva"
+	case header.Get("X-Amz-Cf-Id") != "" || strings.Contains(via, "cloudfront"):
+		return "CloudFront"
+	}
+	return ""
+}
+
+// challengePeekBytes is how much of an error page isChallengePage reads looking for a CDN's block markers
+const challengePeekBytes = 4 << 10
+
+// isChallengePage reports whether resp, an error from behind cdn, is the CDN's own challenge or block page.
+// Most errors from behind a CDN are the origin's, passed through, so it takes a marker only the CDN puts on
+// the pages it serves itself. The start of the body is read for them, and put back for anything after.
+func isChallengePage(resp *http.Response, cdn string) bool {
+	switch cdn {
+	case "Cloudflare":
+		if strings.EqualFold(resp.Header.Get("Cf-Mitigated"), "challenge") {
+			return true
+		}
+	case "Akamai":
+		// Only the edge calls itself AkamaiGHost; the origin's own errors keep its Server header
+		if strings.Contains(resp.Header.Get("Server"), "AkamaiGHost") {
+			return true
+		}
+	case "Sucuri":
+		if resp.Header.Get("X-Sucuri-Block") != "" {
+			return true
+		}
+	}
+
+	markers := map[string][]string{
+		"Cloudflare": {"/cdn-cgi/challenge-platform/"},
+		"Akamai":     {"Reference&#32;&#35;"},
+		"Imperva":    {"_Incapsula_Resource", "Incapsula incident ID"},
+		"Sucuri":     {"Sucuri WebSite Firewall - Access Denied"},
+		"CloudFront": {"Request blocked. We can't connect to the server for this app or website at this time."},
+	}[cdn]
+	if len(markers) == 0 || resp.Body == nil {
+		return false
+	}
+	peek, _ := io.ReadAll(io.LimitReader(resp.Body, challengePeekBytes))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), resp.Body), resp.Body}
+	for _, marker := range markers {
+		if bytes.Contains(peek, []byte(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+func doCloudFlareError(w io.Writer) {
+	fmt.Fprintln(w, "\nCloudflare protection prevents tracing. Sorry!")
+	os.Exit(0)
+}
+
+func doConnectionRefusedError(w io.Writer) {
+	fmt.Fprintln(w, "\nThe connection was refused (possibly because of DNS). Sorry!")
+	os.Exit(0)
+}
+
+func doTimeout(w io.Writer) {
+	fmt.Fprintln(w, "\nThe request timed out. Sorry!")
+	os.Exit(0)
+}
+
+func doValidationError(w io.Writer) {
+	fmt.Fprintln(w, "\nThere was a certification validation error. Sorry!")
+	os.Exit(0)
+}
+
+// hopClient returns the client to trace with: opts.Client (or the default client),
+// on opts.Transport if one was given, and handing back each redirect instead of following it
+func hopClient(opts TraceOptions) *http.Client {
+	if opts.Client == nil && opts.Transport == nil {
+		return client
+	}
+
+	hc := *client
+	if opts.Client != nil {
+		hc = *opts.Client
+	}
+	if opts.Transport != nil {
+		hc.Transport = opts.Transport
+	}
+	hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &hc
+}
+
+// fixtureName names the files for the nth time a request for method and rawURL is made: a hash, as URLs
+// don't make good filenames, and a count, so a chain that comes back to a URL replays in the same order
+func fixtureName(method string, rawURL string, n int) string {
+	sum := sha256.Sum256([]byte(method + " " + rawURL))
+	return fmt.Sprintf("%x-%d", sum[:8], n)
+}
+
+// fixtureBodyLimit is the most of a response body -record saves
+const fixtureBodyLimit = 1 << 20
+
+// fixtureRecorder is the RoundTripper behind -record: it sends each request on through next, and saves
+// the request's headers and the response, its body cut to bodyLimit bytes, to dir, for -replay.
+// Credentials and cookies are masked, as the fixtures are meant for sharing.
+type fixtureRecorder struct {
+	dir       string
+	next      http.RoundTripper
+	bodyLimit int64
+	mu        sync.Mutex
+	seen      map[string]int
+}
+
+func (r *fixtureRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	key := req.Method + " " + req.URL.String()
+	r.seen[key]++
+	name := fixtureName(req.Method, req.URL.String(), r.seen[key])
+	r.mu.Unlock()
+
+	masked := req.Clone(req.Context())
+	masked.Header = maskSecretHeaders(req.Header)
+	request, err := httputil.DumpRequest(masked, false)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error recording request: %w", err)
+	}
+
+	// Only the start of the body is read, and put back in front of the rest for the trace
+	body, err := io.ReadAll(io.LimitReader(resp.Body, r.bodyLimit))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error recording response: %w", err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+
+	saved := *resp
+	saved.Header = maskSecretHeaders(resp.Header)
+	saved.Body = io.NopCloser(bytes.NewReader(body))
+	saved.ContentLength = int64(len(body))
+	saved.TransferEncoding = nil
+	var response bytes.Buffer
+	if err := saved.Write(&response); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error recording response: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, name+".request"), request, 0o600); err != nil {
+		return nil, fmt.Errorf("error recording request: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, name+".response"), response.Bytes(), 0o600); err != nil {
+		return nil, fmt.Errorf("error recording response: %w", err)
+	}
+	return resp, nil
+}
+
+// fixtureReplayer is the RoundTripper behind -replay: it answers each request from what -record saved in dir,
+// without touching the network. A request made more times than it was recorded gets the last recorded response.
+type fixtureReplayer struct {
+	dir  string
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+func (r *fixtureReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	key := req.Method + " " + req.URL.String()
+	r.seen[key]++
+	n := r.seen[key]
+	r.mu.Unlock()
+
+	for ; n > 0; n-- {
+		data, err := os.ReadFile(filepath.Join(r.dir, fixtureName(req.Method, req.URL.String(), n)+".response"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	}
+	return nil, fmt.Errorf("no recorded response for %s %s in %s", req.Method, redactURL(req.URL.String()), r.dir)
+}
+
+// newHopRequest builds the request for one hop of the trace
+func newHopRequest(ctx context.Context, method string, urlStr string, body string, opts TraceOptions) (*http.Request, error) {
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != "" {
+		contentType := opts.ContentType
+		if contentType == "" {
+			contentType = "application/x-www-form-urlencoded"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if cred, ok := opts.Credentials[strings.ToLower(req.URL.Hostname())]; ok {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+
+	// Set the user agent header
+	userAgent := opts.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	// Extra headers go last, so they can replace any of the above
+	for _, headers := range []http.Header{opts.Headers, opts.HostHeaders[strings.ToLower(req.URL.Hostname())]} {
+		for name, values := range headers {
+			if name == "Host" {
+				req.Host = values[0]
+				continue
+			}
+			req.Header[name] = values
+		}
+	}
+
+	return req, nil
+}
+
+// digestAuthorization answers the first Digest challenge among challenges (RFC 7616), returning the
+// Authorization header to retry with, or "" if there's no Digest challenge this can answer
+func digestAuthorization(challenges []string, method string, uri string, cred Credential) string {
+	var params map[string]string
+	for _, challenge := range challenges {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		if strings.EqualFold(scheme, "Digest") {
+			params = parseAuthParams(rest)
+			break
+		}
+	}
+	if params == nil || params["nonce"] == "" {
+		return ""
+	}
+
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var hash func(string) string
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		hash = func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	case "SHA-256":
+		hash = func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }
+	default:
+		return ""
+	}
+
+	// Only qop=auth is supported; auth-int would mean hashing the body
+	qop := ""
+	if params["qop"] != "" {
+		for _, offered := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(offered) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return ""
+		}
+	}
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return ""
+	}
+	cnonce := fmt.Sprintf("%x", cnonceBytes)
+	nc := "00000001"
+
+	ha1 := hash(cred.Username + ":" + params["realm"] + ":" + cred.Password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = hash(ha1 + ":" + params["nonce"] + ":" + cnonce)
+	}
+	ha2 := hash(method + ":" + uri)
+
+	var response string
+	if qop != "" {
+		response = hash(strings.Join([]string{ha1, params["nonce"], nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = hash(ha1 + ":" + params["nonce"] + ":" + ha2)
+	}
+
+	header := fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=%s, response=%q`,
+		cred.Username, params["realm"], params["nonce"], uri, algorithm, response)
+	if qop != "" {
+		header += fmt.Sprintf(`, qop=%s, nc=%s, cnonce=%q`, qop, nc, cnonce)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque=%q`, opaque)
+	}
+	return header
+}
+
+// parseAuthParams splits the comma-separated key=value (or key="quoted value") pairs of an auth challenge
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " \t,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// Quoted string, with backslash escapes
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// requestError maps a failed request onto one of the Err* values where possible
+func requestError(err error) error {
+	if strings.Contains(err.Error(), "connection refused") {
+		return ErrConnectionRefused
+	}
+
+	if err, ok := err.(*url.Error); ok && err.Timeout() {
+		return ErrTimeout
+	}
+
+	if strings.Contains(err.Error(), "x509: certificate signed by unknown authority") {
+		// Handle certificate verification error
+		return ErrCertValidation
+	}
+
+	return fmt.Errorf("error accessing URL: %s", err)
+}
+
+// followRedirects traces urlStr until it stops redirecting
+// If ctx is cancelled mid-trace, the hops gathered so far are returned along with ctx.Err()
+func followRedirects(ctx context.Context, urlStr string, opts TraceOptions) (string, []Hop, error) {
+	finalURL, hops, err := walkRedirects(ctx, urlStr, opts)
+	markHops(hops, err)
+	for i := range hops {
+		if hops[i].bodyRead != nil {
+			hops[i].BytesReceived += *hops[i].bodyRead
+		}
+	}
+	return finalURL, hops, err
+}
+
+// Unshorten traces rawURL with the default options and returns the clean URL it ends at, for callers that
+// only want the destination and not the whole TraceResult. It's followRedirects and newTraceResult in one call.
+func Unshorten(ctx context.Context, rawURL string) (string, error) {
+	finalURL, hops, err := followRedirects(ctx, rawURL, TraceOptions{})
+	if err != nil {
+		return "", err
+	}
+	if finalURL == "" {
+		return "", fmt.Errorf("%s redirected without saying where to", rawURL)
+	}
+	return newTraceResult(rawURL, finalURL, hops).CleanURL, nil
+}
+
+// unwrapQueryParam rebuilds u with name as its only query parameter, or returns "" if u doesn't carry it.
+// Query has already decoded the value once, so it's used as it is, and Encode escapes it again for the new query.
+func unwrapQueryParam(u *url.URL, name string) string {
+	value := u.Query().Get(name)
+	if value == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + u.Path + "?" + url.Values{name: {value}}.Encode()
+}
+
+// markHops sets IsFinal on the landing hop, if the chain got to one (err is nil, or one of those that
+// keep the result), and IsRedirect on the hops the chain moved on from, or would have with -peek
+func markHops(hops []Hop, err error) {
+	landed := err == nil || (keepsResult(err) && !cutShort(err))
+	for i := range hops {
+		hops[i].IsFinal = landed && i == len(hops)-1
+		hops[i].IsRedirect = i < len(hops)-1 || hops[i].location != ""
+	}
+}
+
+// walkRedirects does the work of followRedirects, one hop at a time
+func walkRedirects(ctx context.Context, urlStr string, opts TraceOptions) (string, []Hop, error) {
+	hops := []Hop{}
+	number := 1
+
+	record := func(hop Hop) {
+		hops = append(hops, hop)
+		if opts.Logger != nil {
+			opts.Logger.Info("hop", "url", redactURL(hop.URL), "status", hop.StatusCode, "hop", hop.Number, "duration", hop.DurationMs)
+		}
+	}
+
+	// OnHop only sees a hop once its notes are settled: when the chain moves on from it, or on the way out
+	announced := 0
+	announce := func() {
+		for ; announced < len(hops); announced++ {
+			if opts.OnHop != nil {
+				opts.OnHop(hops[announced])
+			}
+		}
+	}
+	defer announce()
+
+	httpClient := hopClient(opts)
+
+	// Body bytes left in the -max-total-bytes budget, shared by every hop
+	budget := opts.MaxTotalBytes
+
+	if opts.URLDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.URLDeadline)
+		defer cancel()
+	}
+
+	// The method (and body) can change as redirects are followed
+	method := strings.ToUpper(opts.Method)
+	body := opts.Data
+	if method == "" && body != "" {
+		method = "POST"
+	} else if method == "" {
+		method = "GET"
+	}
+
+	// The origin the chain started at, for -same-origin
+	startOrigin := ""
+	if start, err := url.Parse(urlStr); err == nil {
+		startOrigin = originOf(start)
+	}
+
+	// https -> http redirects seen so far, and whether the latest hop was one
+	downgrades := 0
+	lastDowngrade := false
+
+	var previousURL *url.URL
+
+	// Use a set to keep track of visited URLs
+	visitedURLs := make(map[string]int)
+
+	// Ensure the initial URL is marked as visited
+	visitedURLs[urlStr] = 1
+
+	// Hops per host, to catch A -> B -> A -> B chains that never repeat an exact URL
+	hostVisits := make(map[string]int)
+
+	// Host changes so far, and the host they're counted from, for -max-host-changes
+	changes := 0
+	lastHost := ""
+
+	// The host of every URL so far, to spot chains that go round the same hosts with ever-new URLs
+	var hostSequence []string
+
+	// The -hop-timeout deadline of the hop being fetched, released as soon as the chain moves on from it
+	cancelHop := context.CancelFunc(func() {})
+	defer func() { cancelHop() }()
+
+	for {
+		// A chain of endless new URLs never trips the loop checks, so cap its length
+		if opts.MaxHops > 0 && number > opts.MaxHops {
+			return "", hops, fmt.Errorf("%w (more than %d hops)", ErrTooManyRedirects, opts.MaxHops)
+		}
+
+		// Check if the URL has been visited before
+		if visitedURLs[urlStr] > 1 {
+			// Redirect loop detected
+			record(Hop{
+				Number:          number,
+				URL:             urlStr,
+				StatusCode:      http.StatusLoopDetected,
+				StatusCodeClass: statusClass(http.StatusLoopDetected),
+			})
+			return urlStr, hops, nil
+		} else {
+			visitedURLs[urlStr]++
+		}
+
+		if opts.MaxPerHost > 0 {
+			host := strings.ToLower(hostOf(urlStr))
+			hostVisits[host]++
+			if hostVisits[host] > opts.MaxPerHost {
+				record(Hop{
+					Number:          number,
+					URL:             urlStr,
+					StatusCode:      http.StatusLoopDetected,
+					StatusCodeClass: statusClass(http.StatusLoopDetected),
+					Note:            fmt.Sprintf("loop: %s visited more than %d times", host, opts.MaxPerHost),
+				})
+				return urlStr, hops, nil
+			}
+		}
+
+		// Same-host redirects are free; it's hopping across domains that -max-host-changes limits
+		host := strings.ToLower(hostOf(urlStr))
+		if lastHost != "" && host != lastHost {
+			changes++
+			if opts.MaxHostChanges > 0 && changes > opts.MaxHostChanges {
+				record(Hop{
+					Number: number,
+					URL:    urlStr,
+					Note:   fmt.Sprintf("not followed (more than %d host changes)", opts.MaxHostChanges),
+				})
+				return urlStr, hops, nil
+			}
+		}
+		lastHost = host
+
+		hostSequence = append(hostSequence, host)
+		if cycle := hostCycle(hostSequence, cycleRepeats); cycle != nil {
+			return "", hops, fmt.Errorf("%w: %s, %d times over", ErrCyclicRedirect, strings.Join(append(cycle, cycle[0]), " -> "), cycleRepeats)
+		}
+
+		// With -stop-on-tracking, the first redirect that brings in a tracking parameter is where the chain gets
+		// reported. Whatever the starting URL already carried isn't the chain's doing.
+		if opts.StopOnTracking && len(hops) > 0 {
+			if param := addedTrackingParam(urlStr, hops[len(hops)-1].URL); param != "" {
+				record(Hop{
+					Number:        number,
+					URL:           urlStr,
+					Note:          fmt.Sprintf("not followed (tracking parameter %s)", param),
+					TrackingParam: param,
+				})
+				return urlStr, hops, nil
+			}
+		}
+
+		// With -head-then-get, try a cheap HEAD before falling back to GET
+		reqMethod := method
+		if opts.HeadThenGet && method == "GET" {
+			reqMethod = "HEAD"
+		}
+
+		// With -hop-timeout, this hop gets its own deadline, on top of the chain's
+		hopCtx := ctx
+		if opts.HopTimeout > 0 {
+			var cancel context.CancelFunc
+			hopCtx, cancel = context.WithTimeout(ctx, opts.HopTimeout)
+			cancelHop = cancel
+		}
+
+		req, err := newHopRequest(hopCtx, reqMethod, urlStr, body, opts)
+		if err != nil {
+			return "", nil, fmt.Errorf("error creating request: %s", err)
+		}
+
+		// time.Since uses the monotonic clock, so durations survive wall-clock jumps
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+
+		// No Location from HEAD (a 405, or a page that only redirects on GET): ask again with GET
+		if err == nil && reqMethod == "HEAD" && resp.Header.Get("Location") == "" {
+			resp.Body.Close()
+
+			reqMethod = "GET"
+			req, err = newHopRequest(hopCtx, reqMethod, urlStr, body, opts)
+			if err != nil {
+				return "", nil, fmt.Errorf("error creating request: %s", err)
+			}
+			resp, err = httpClient.Do(req)
+		}
+
+		// A Digest challenge we have a login for: answer it and ask again
+		if err == nil && resp.StatusCode == http.StatusUnauthorized {
+			if cred, ok := opts.Credentials[strings.ToLower(req.URL.Hostname())]; ok {
+				if authorization := digestAuthorization(resp.Header.Values("WWW-Authenticate"), reqMethod, req.URL.RequestURI(), cred); authorization != "" {
+					resp.Body.Close()
+
+					req, err = newHopRequest(hopCtx, reqMethod, urlStr, body, opts)
+					if err != nil {
+						return "", nil, fmt.Errorf("error creating request: %s", err)
+					}
+					req.Header.Set("Authorization", authorization)
+					resp, err = httpClient.Do(req)
+				}
+			}
+		}
+
+		elapsed := time.Since(start)
+		if err != nil {
+			// Out of time: the URL we were fetching ends the chain
+			if opts.URLDeadline > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				record(Hop{
+					Number: number,
+					URL:    urlStr,
+					Note:   fmt.Sprintf("not followed (time budget of %s exhausted)", opts.URLDeadline),
+				})
+				return urlStr, hops, fmt.Errorf("%w (%s, at %s)", ErrURLDeadline, opts.URLDeadline, hostOf(urlStr))
+			}
+
+			// No response from this hop in time, so nowhere to go next
+			if opts.HopTimeout > 0 && errors.Is(hopCtx.Err(), context.DeadlineExceeded) {
+				record(Hop{
+					Number:   number,
+					URL:      urlStr,
+					TimedOut: true,
+					Note:     fmt.Sprintf("no response within the hop timeout of %s", opts.HopTimeout),
+				})
+				return urlStr, hops, fmt.Errorf("%w (%s, after %s)", ErrHopTimeout, hostOf(urlStr), opts.HopTimeout)
+			}
+
+			// Interrupted: hand back what we have so far
+			if ctx.Err() != nil {
+				return urlStr, hops, ctx.Err()
+			}
+
+			// Close response body in case of error
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+
+			return "", nil, requestError(err)
+		}
+
+		bodyRead := new(int64)
+		if resp != nil && resp.Body != nil {
+			defer resp.Body.Close()
+			if opts.MaxTotalBytes > 0 {
+				resp.Body = &budgetedBody{ReadCloser: resp.Body, remaining: &budget}
+			}
+			resp.Body = &countedBody{ReadCloser: resp.Body, read: bodyRead}
+		}
+
+		hop := Hop{
+			Number:          number,
+			URL:             urlStr,
+			StatusCode:      resp.StatusCode,
+			StatusCodeClass: statusClass(resp.StatusCode),
+			Method:          reqMethod,
+			DurationMs:      float64(elapsed.Microseconds()) / 1000,
+			Shortener:       shortenerFor(req.URL.Hostname()),
+			Proto:           resp.Proto,
+			ContentLength:   resp.ContentLength,
+			Server:          resp.Header.Get("Server"),
+			CDN:             detectCDN(resp.Header),
+			BytesSent:       requestSize(req),
+			BytesReceived:   responseHeaderSize(resp),
+			bodyRead:        bodyRead,
+		}
+		if opts.RequireHTTPS && strings.EqualFold(req.URL.Scheme, "http") {
+			hop.Insecure = true
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			hop.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		if opts.Capture {
+			hop.started = start
+			hop.requestHeader = req.Header.Clone()
+			hop.responseHeader = resp.Header.Clone()
+			hop.statusText = resp.Status
+		}
+		if resp.TLS != nil {
+			hop.TLSVersion = tls.VersionName(resp.TLS.Version)
+			hop.TLSCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+		}
+		if opts.Timestamps {
+			wallClock := start.Round(0)
+			hop.Timestamp = &wallClock
+		}
+		record(hop)
+
+		if followsStatus(opts.FollowCodes, resp.StatusCode) {
+			// There should only be one Location. If a server sends several, the first is followed
+			// (as browsers and resp.Header.Get do), and the hop says how many there were.
+			location := resp.Header.Get("Location")
+			if locations := resp.Header.Values("Location"); len(locations) > 1 {
+				addNote(&hops[len(hops)-1], fmt.Sprintf("%d Location headers, following the first", len(locations)))
+				if opts.Logger != nil {
+					opts.Logger.Warn("multiple locations", "url", redactURL(urlStr), "hop", number, "count", len(locations))
+				}
+			}
+			if location == "" {
+				if strings.Contains(resp.Header.Get("Server"), "cloudflare") {
+					return "", []Hop{}, ErrCloudflare
+				}
+				return "", []Hop{}, nil // Return empty slice of Hop when redirect location is not found
+			}
+			// Peeking: note where the redirect goes, and go no further
+			if opts.Peek {
+				target := location
+				if scheme := uriScheme(location); scheme == "" || isHTTPScheme(scheme) {
+					if u, err := handleRelativeRedirect(previousURL, location, req.URL); err == nil {
+						target = u.String()
+					}
+				}
+				hops[len(hops)-1].location = target
+				return urlStr, hops, nil
+			}
+
+			if strings.HasPrefix(location, "https://outlook.office365.com") {
+				// Only include the final request as the last hop
+				finalHop := Hop{
+					Number:          number + 2, // Increment the hop number for the final request
+					URL:             location,
+					StatusCode:      http.StatusOK, // Set the status code to 200 for the final request
+					StatusCodeClass: statusClass(http.StatusOK),
+				}
+				record(finalHop)
+
+				return location, hops, nil
+			}
+
+			// Only http(s) targets can be followed; anything else ends the trace here.
+			// The scheme is read by hand, since data: and javascript: URIs often don't survive url.Parse.
+			if scheme := uriScheme(location); scheme != "" && !isHTTPScheme(scheme) {
+				note := fmt.Sprintf("not followed (%s: scheme)", scheme)
+				if scheme == "data" {
+					note = fmt.Sprintf("not followed (data: scheme, %s)", dataMediaType(location))
+				}
+				record(Hop{
+					Number: number + 1,
+					URL:    location,
+					Note:   note,
+				})
+
+				return location, hops, nil
+			}
+
+			redirectURL, err := handleRelativeRedirect(previousURL, location, req.URL)
+			if err != nil {
+				return "", nil, fmt.Errorf("error handling relative redirect: %s", err)
+			}
+
+			// A host that redirects to whatever host its query names may be an open redirect
+			if param := openRedirectParam(req.URL, redirectURL); param != "" {
+				hops[len(hops)-1].OpenRedirectSuspected = true
+				if opts.Logger != nil {
+					opts.Logger.Warn("open redirect suspected", "url", redactURL(urlStr), "hop", number, "param", param)
+				}
+			}
+
+			// Convert redirectURL to a string
+			redirectURLString := redirectURL.String()
+
+			// A meta refresh in a redirect's body should agree with its Location; if not, it's worth a look
+			if opts.Meta && reqMethod != "HEAD" {
+				target, err := readMetaRefresh(resp, req.URL, opts.MaxBody)
+				if err != nil {
+					addNote(&hops[len(hops)-1], fmt.Sprintf("stopped reading the body: the %d-byte budget ran out", opts.MaxTotalBytes))
+					return urlStr, hops, err
+				}
+				if target != "" {
+					current := &hops[len(hops)-1]
+					current.MetaRefresh = target
+					if canonicalURL(target) != canonicalURL(redirectURLString) {
+						current.MetaMismatch = true
+						if opts.Logger != nil {
+							opts.Logger.Warn("meta refresh mismatch", "url", redactURL(urlStr), "hop", number, "location", redactURL(redirectURLString), "meta", redactURL(target))
+						}
+					}
+				}
+			}
+
+			// Check if the "returnUri" query parameter is present
+			u, err := url.Parse(redirectURLString)
+			if err != nil {
+				return "", nil, fmt.Errorf("error parsing URL: %s", err)
+			}
+			// Unwrapping can be turned off to follow exactly what Location says
+			if !opts.NoUnwrap {
+				for _, name := range []string{"returnUri", "redir"} {
+					if unwrapped := unwrapQueryParam(u, name); unwrapped != "" {
+						redirectURLString = unwrapped
+					}
+				}
+			}
+
+			// Some redirectors carry the destination base64-encoded; reveal it, and skip straight to it
+			if target := base64Target(u.Query(), opts.B64Params); target != "" {
+				hops[len(hops)-1].Base64Target = target
+				if opts.Logger != nil {
+					opts.Logger.Info("base64 target", "url", redactURL(urlStr), "hop", number, "target", redactURL(target))
+				}
+				if !opts.NoUnwrap {
+					redirectURLString = target
+					u, _ = url.Parse(target)
+				}
+			}
+
+			// With -same-origin, leaving the starting scheme/host/port ends the trace at the redirect target
+			if opts.SameOrigin && originOf(u) != startOrigin {
+				record(Hop{
+					Number: number + 1,
+					URL:    redirectURLString,
+					Note:   fmt.Sprintf("not followed (leaves %s)", startOrigin),
+				})
+				return redirectURLString, hops, nil
+			}
+
+			// Note (and maybe refuse) redirects from https down to plain http
+			lastDowngrade = req.URL.Scheme == "https" && strings.EqualFold(u.Scheme, "http")
+			if lastDowngrade {
+				hops[len(hops)-1].Downgrade = true
+				downgrades++
+
+				if (opts.NoDowngrade && !opts.AllowDowngradeOnce) || (opts.AllowDowngradeOnce && downgrades > 1) {
+					return "", hops, ErrDowngrade
+				}
+			}
+
+			// Same rules as browsers: 301/302/303 turn into a bodiless GET, 307/308 repeat the request as-is
+			switch resp.StatusCode {
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+				if method != "GET" && method != "HEAD" {
+					method = "GET"
+					body = ""
+				}
+			}
+
+			if opts.Logger != nil {
+				opts.Logger.Info("redirect", "url", redactURL(urlStr), "status", resp.StatusCode, "hop", number, "location", redactURL(redirectURLString))
+			}
+			// Done with this response: finish it off now, so its connection can carry the next hop
+			if err := drainBody(resp.Body, opts.NoBody); err != nil {
+				addNote(&hops[len(hops)-1], fmt.Sprintf("stopped reading the body: the %d-byte budget ran out", opts.MaxTotalBytes))
+				return urlStr, hops, err
+			}
+			// A slow body doesn't matter once the Location is in hand
+			if opts.HopTimeout > 0 && errors.Is(hopCtx.Err(), context.DeadlineExceeded) {
+				hops[len(hops)-1].TimedOut = true
+			}
+			cancelHop()
+			urlStr = redirectURLString
+			number++
+
+			previousURL, err = url.Parse(urlStr)
+			if err != nil {
+				return "", nil, fmt.Errorf("error parsing URL: %s", err)
+			}
+			hops[len(hops)-1].IsRedirect = true
+			announce()
+			continue
+		}
+
+		// A single downgrade is only tolerated on the way through, not at the landing page
+		if opts.AllowDowngradeOnce && lastDowngrade {
+			return "", hops, ErrDowngrade
+		}
+
+		// Only the landing page's content type matters; redirect pages are nearly always HTML
+		landing := &hops[len(hops)-1]
+		switch {
+		case resp.StatusCode == http.StatusUseProxy:
+			addNote(landing, "not followed (305 Use Proxy is deprecated: its Location is a proxy, not a page)")
+		case resp.StatusCode == 306:
+			addNote(landing, "not followed (306 is an unused, reserved code)")
+		case landing.StatusCodeClass == "3xx":
+			addNote(landing, fmt.Sprintf("not followed (%d isn't a followed redirect code)", resp.StatusCode))
+		}
+		// A WebSocket endpoint: there's nothing further to follow, and no body to read
+		upgrade := resp.Header.Get("Upgrade")
+		switch {
+		case resp.StatusCode == http.StatusSwitchingProtocols && strings.EqualFold(upgrade, "websocket"):
+			addNote(landing, "WebSocket upgrade")
+		case resp.StatusCode == http.StatusSwitchingProtocols:
+			addNote(landing, fmt.Sprintf("switched protocols (to %s)", cmp.Or(upgrade, "an unnamed protocol")))
+		case resp.StatusCode == http.StatusUpgradeRequired && strings.EqualFold(upgrade, "websocket"):
+			addNote(landing, "expects a WebSocket upgrade")
+		}
+		// A CDN or WAF turning the trace away with its own challenge or block page, rather than passing on
+		// the origin's error. The chain is still worth showing.
+		if landing.CDN != "" && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) &&
+			isChallengePage(resp, landing.CDN) {
+			addNote(landing, fmt.Sprintf("blocked by %s (challenge or WAF page)", landing.CDN))
+			if opts.FailOnError {
+				landing.ContentType = resp.Header.Get("Content-Type")
+				return urlStr, hops, fmt.Errorf("%w (%s, %d)", ErrBlocked, landing.CDN, resp.StatusCode)
+			}
+		}
+
+		landing.ContentType = resp.Header.Get("Content-Type")
+		if len(opts.ExpectTypes) > 0 && !matchesMediaType(landing.ContentType, opts.ExpectTypes) {
+			landing.UnexpectedType = true
+		}
+		if len(opts.ExpectFinal) > 0 && !matchesFinalURL(urlStr, opts.ExpectFinal) {
+			landing.UnexpectedFinal = true
+		}
+
+		// Nothing below needs the landing page's body unless it's being saved
+		if opts.NoBody && opts.SaveBody == "" {
+			resp.Body.Close()
+		}
+
+		if opts.SaveBody != "" && resp.StatusCode != http.StatusSwitchingProtocols {
+			truncated, err := saveBody(opts.SaveBody, resp.Body, opts.MaxBody)
+			if errors.Is(err, ErrByteBudget) {
+				addNote(landing, fmt.Sprintf("stopped reading the body: the %d-byte budget ran out", opts.MaxTotalBytes))
+				return urlStr, hops, err
+			}
+			if err != nil {
+				return urlStr, hops, fmt.Errorf("error saving body: %w", err)
+			}
+			if truncated {
+				addNote(landing, fmt.Sprintf("body truncated to %d bytes", opts.MaxBody))
+			}
+		}
 
+		if opts.FailOnError && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			return urlStr, hops, fmt.Errorf("%w: %d", ErrBadFinalStatus, resp.StatusCode)
+		}
+		if opts.FailOnError && landing.UnexpectedType {
+			return urlStr, hops, fmt.Errorf("%w: %q", ErrUnexpectedType, landing.ContentType)
+		}
+		if opts.FailOnError && landing.UnexpectedFinal {
+			return urlStr, hops, fmt.Errorf("%w: %s", ErrUnexpectedFinal, redactURL(urlStr))
+		}
+		if i := slices.IndexFunc(hops, func(hop Hop) bool { return hop.Insecure }); opts.FailOnError && i >= 0 {
+			return urlStr, hops, fmt.Errorf("%w (hop %d)", ErrInsecureHop, hops[i].Number)
+		}
+
+		return urlStr, hops, nil
+	}
+}
+
+// matchesMediaType reports whether contentType's media type is one of patterns, where "type/*" covers a whole type
+func matchesMediaType(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mediaType || pattern == "*/*" || pattern == "*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// base64Target returns the first of params in query whose value base64-decodes (standard or URL-safe,
+// padded or not) to an absolute http(s) URL, or "" if none does
+func base64Target(query url.Values, params []string) string {
+	encodings := []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding}
+
+	for _, param := range params {
+		// Query decoding turns an unescaped + into a space
+		value := strings.ReplaceAll(query.Get(strings.TrimSpace(param)), " ", "+")
+		if value == "" {
+			continue
+		}
+		for _, encoding := range encodings {
+			decoded, err := encoding.DecodeString(value)
+			if err != nil {
+				continue
+			}
+			target := strings.TrimSpace(string(decoded))
+			if u, err := url.Parse(target); err == nil && isHTTPScheme(u.Scheme) && u.Host != "" {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+// matchesFinalURL reports whether finalURL is one of patterns. A pattern without a scheme is a hostname;
+// otherwise it's a whole URL, compared with and without tracking parameters. In both, * matches any run of characters.
+func matchesFinalURL(finalURL string, patterns []string) bool {
+	u, err := url.Parse(finalURL)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if !strings.Contains(pattern, "://") {
+			if globMatch(strings.ToLower(pattern), strings.ToLower(u.Hostname())) {
+				return true
+			}
+			continue
+		}
+		if globMatch(pattern, finalURL) || globMatch(pattern, makeCleanURL(finalURL)) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches s against a pattern where * stands for any run of characters, slashes included.
+// It's greedy with a single backtrack point, the last *, so it runs in O(len(pattern)*len(s)) however many stars.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, retry := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			// Try the star as empty first; on a mismatch it takes one more character
+			star, retry = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			retry++
+			p, i = star+1, retry
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// metaRefreshPattern finds <meta http-equiv="refresh" content="..."> tags, with the attributes in either order
+var metaRefreshPattern = regexp.MustCompile(`(?is)<meta\s[^>]*?(?:http-equiv\s*=\s*["']?refresh["']?[^>]*?content\s*=\s*(?:"([^"]*)"|'([^']*)')|content\s*=\s*(?:"([^"]*)"|'([^']*)')[^>]*?http-equiv\s*=\s*["']?refresh["']?)`)
+
+// metaRefreshLimit is the most of a page readMetaRefresh reads: a meta refresh belongs in <head>, near the top
+const metaRefreshLimit = 64 << 10
+
+// readMetaRefresh reads the start of an HTML response's body (up to limit bytes, or metaRefreshLimit if that's
+// less or limit is 0) and returns the target of its meta refresh, resolved against pageURL. What was read is
+// put back in front of the rest of the body. "" means the page has no meta refresh that goes anywhere.
+// The only error is ErrByteBudget, when the read spends -max-total-bytes; other read errors just cut the page short.
+func readMetaRefresh(resp *http.Response, pageURL *url.URL, limit int64) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return "", nil
+	}
+
+	if limit <= 0 || limit > metaRefreshLimit {
+		limit = metaRefreshLimit
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if errors.Is(err, ErrByteBudget) {
+		return "", err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(page), resp.Body), resp.Body}
+
+	match := metaRefreshPattern.FindSubmatch(page)
+	if match == nil {
+		return "", nil
+	}
+	var content string
+	for _, group := range match[1:] {
+		if len(group) > 0 {
+			content = html.UnescapeString(string(group))
+			break
+		}
+	}
+
+	// content is "5; url=https://example.com/", or just "5" for a plain reload
+	_, rest, _ := strings.Cut(content, ";")
+	rest = strings.TrimSpace(rest)
+	if len(rest) < 4 || !strings.EqualFold(rest[:3], "url") {
+		return "", nil
+	}
+	target := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest[3:]), "="))
+	target = strings.Trim(target, `"'`)
+	if target == "" {
+		return "", nil
+	}
+
+	if scheme := uriScheme(target); scheme != "" && !isHTTPScheme(scheme) {
+		return target, nil
+	}
+	resolved, err := pageURL.Parse(target)
+	if err != nil {
+		return "", nil
+	}
+	return resolved.String(), nil
+}
+
+// drainLimit is how much of a redirect's body is read and thrown away to keep its connection open
+const drainLimit = 4 << 10
+
+// drainBody closes a response body that isn't needed. An HTTP/1.1 connection only goes back in the pool
+// once its body has been read to the end, so unless noBody is set, up to drainLimit bytes are read first:
+// redirect bodies are tiny, and that saves the next hop to the same host a new TCP and TLS handshake.
+// It returns ErrByteBudget if that read spends -max-total-bytes.
+func drainBody(body io.ReadCloser, noBody bool) error {
+	defer body.Close()
+	if noBody {
+		return nil
+	}
+	if _, err := io.CopyN(io.Discard, body, drainLimit); errors.Is(err, ErrByteBudget) {
+		return err
+	}
 	return nil
 }
 
-func printUsageMessage() {
-	fmt.Printf("\n%sUsage%s: go-trace [options] <URL>\n\n\t%sOptions%s:\n\t-h: prints this help message\n\t-j: outputs as JSON\n\t-s: prints only the final/clean URL\n\t-v: shows all hops\n\t-w: sets the width of the URL tab (line wraps here)\n\n\t%sDefaults%s:\n\t-j: Off\n\t-v: Off (Final/Clean URL only)\n\t-w: 120\n\n", underline, reset, underline, reset, underline, reset)
+// countedBody keeps a count of the bytes read from a response body, for Hop.BytesReceived
+type countedBody struct {
+	io.ReadCloser
+	read *int64
 }
 
-func printTraceResult(redirectURL string, hops []Hop, cloudflareStatus bool, viewOption string) {
-	cleanedURL := makeCleanURL(redirectURL)
+func (c *countedBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	*c.read += int64(n)
+	return n, err
+}
 
-	if cloudflareStatus {
-		doCloudFlareError()
+// headerSize is how long header is written out as HTTP/1.1 text, "Name: value\r\n" for each value
+func headerSize(header http.Header) int64 {
+	size := 0
+	for name, values := range header {
+		for _, value := range values {
+			size += len(name) + len(": ") + len(value) + len("\r\n")
+		}
 	}
+	return int64(size)
+}
 
-	switch {
-	case viewOption == "terse":
-		if cleanedURL != redirectURL {
-			fmt.Println(cleanedURL)
+// requestSize estimates the bytes req takes to send as HTTP/1.1: its request line, Host and other headers,
+// and body. Headers the transport adds itself (Accept-Encoding, cookies from a jar...) aren't counted.
+func requestSize(req *http.Request) int64 {
+	size := int64(len(req.Method) + len(" ") + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n"))
+	size += int64(len("Host: ") + len(cmp.Or(req.Host, req.URL.Host)) + len("\r\n"))
+	size += headerSize(req.Header) + int64(len("\r\n"))
+	return size + max(req.ContentLength, 0)
+}
+
+// responseHeaderSize estimates the bytes of resp before its body, as HTTP/1.1: the status line and headers
+func responseHeaderSize(resp *http.Response) int64 {
+	return int64(len(resp.Proto)+len(" ")+len(resp.Status)+len("\r\n")) + headerSize(resp.Header) + int64(len("\r\n"))
+}
+
+// budgetedBody counts the bytes read from a response body against a budget shared by the whole trace,
+// failing with ErrByteBudget once the body turns out to be longer than what's left
+type budgetedBody struct {
+	io.ReadCloser
+	remaining *int64
+}
+
+func (b *budgetedBody) Read(p []byte) (int, error) {
+	if *b.remaining <= 0 {
+		// Spent exactly: fine if the body ends here too
+		if n, _ := b.ReadCloser.Read(make([]byte, 1)); n > 0 {
+			return 0, ErrByteBudget
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > *b.remaining {
+		p = p[:*b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	*b.remaining -= int64(n)
+	return n, err
+}
+
+// saveBody writes up to limit bytes of body to path (all of it if limit is 0),
+// and reports whether there was more that didn't fit
+func saveBody(path string, body io.Reader, limit int64) (bool, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if limit <= 0 {
+		_, err = io.Copy(f, body)
+		return false, err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(body, limit))
+	if err != nil {
+		return false, err
+	}
+	if n < limit {
+		return false, nil
+	}
+
+	// Peek for one more byte to tell "exactly limit" from "cut short"
+	extra, _ := body.Read(make([]byte, 1))
+	return extra > 0, nil
+}
+
+// The redirect codes that are followed by default. 300 (Multiple Choices), 304 (Not Modified),
+// 305 (Use Proxy) and 306 (unused) aren't really redirects, so they end the trace.
+var defaultFollowCodes = []int{
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// followsStatus reports whether a response with this status code should be followed
+func followsStatus(codes []int, code int) bool {
+	if codes == nil {
+		codes = defaultFollowCodes
+	}
+	return slices.Contains(codes, code)
+}
+
+// parseFollowCodes reads -follow-codes' comma-separated list of 3xx codes
+func parseFollowCodes(list string) ([]int, error) {
+	var codes []int
+	for _, field := range strings.Split(list, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || code < 300 || code > 399 {
+			return nil, fmt.Errorf("%q isn't a 3xx status code", strings.TrimSpace(field))
+		}
+		// A 305's Location names a proxy to send the request through, not a page; it's never safe to follow
+		if code == http.StatusUseProxy || code == 306 {
+			return nil, fmt.Errorf("%d can't be followed", code)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func handleRelativeRedirect(previousURL *url.URL, location string, requestURL *url.URL) (*url.URL, error) {
+	redirectURL, err := url.Parse(location)
+	if err != nil {
+		log.Printf("Error parsing redirect URL: %v", err)
+		return nil, err
+	}
+
+	if redirectURL.Scheme == "" {
+		// If the scheme is missing, set it to the scheme of the previous URL or the request URL
+		if previousURL != nil {
+			redirectURL.Scheme = previousURL.Scheme
+		} else if requestURL != nil {
+			redirectURL.Scheme = requestURL.Scheme
 		} else {
-			fmt.Println(redirectURL)
+			return nil, errors.New("missing scheme for relative redirect")
 		}
+	}
 
-	case viewOption == "short":
-		// Print additional information
-		fmt.Fprintf(os.Stdout, "\n%sFinal URL%s:     %s\n", boldBlue, reset, formatURL(redirectURL))
+	if redirectURL.Host == "" {
+		// If the host is missing, set it to the host of the previous URL or the request URL
+		if previousURL != nil {
+			redirectURL.Host = previousURL.Host
+		} else if requestURL != nil {
+			redirectURL.Host = requestURL.Host
+		} else {
+			return nil, errors.New("missing host for relative redirect")
+		}
+	}
 
-		if cleanedURL != redirectURL {
-			fmt.Fprintf(os.Stdout, "\n%sClean URL%s:     %s\n\n", green, reset, cleanedURL)
+	return redirectURL, nil
+}
+
+// newTraceResult assembles the result of tracing originalURL
+func newTraceResult(originalURL string, finalURL string, hops []Hop) TraceResult {
+	if normalizeEncoding && finalURL != "" {
+		finalURL = normalizeURLEncoding(finalURL)
+	}
+	result := TraceResult{
+		SchemaVersion: schemaVersion,
+		OriginalURL:   originalURL,
+		Hops:          hops,
+		FinalURL:      finalURL,
+	}
+	if finalURL != "" {
+		result.CleanURL = makeCleanURL(finalURL)
+	}
+	// Redirected away only to come back: usually a misconfigured redirector. A chain cut short as a loop
+	// didn't land anywhere, even if its last hop points back at the start.
+	if len(hops) > 1 && finalURL != "" && canonicalURL(finalURL) == canonicalURL(originalURL) {
+		last := hops[len(hops)-1]
+		result.ReturnsToStart = last.IsFinal && last.StatusCode != http.StatusLoopDetected
+	}
+	result.Hosts = uniqueHosts(hops)
+	result.UniqueHosts = len(result.Hosts)
+	result.HostChanges = hostChanges(hops)
+	result.StatusClasses = statusClassCounts(hops)
+	// Cleaning decodes the URL, so it's normalized again
+	if normalizeEncoding && result.CleanURL != "" {
+		result.CleanURL = normalizeURLEncoding(result.CleanURL)
+	}
+	// After cleaning, so only the parameters that survived the tracking filter are sorted
+	if sortQuery && result.CleanURL != "" {
+		result.CleanURL = sortQueryParams(result.CleanURL)
+	}
+	if trimSlash && result.CleanURL != "" {
+		result.CleanURL = trimTrailingSlash(result.CleanURL)
+	}
+	if canonicalize && finalURL != "" {
+		result.CanonicalURL = canonicalURL(result.CleanURL)
+	}
+	if u, err := url.Parse(finalURL); err == nil && u.RawQuery != "" {
+		result.FinalQuery = u.Query()
+		result.AddedParams = addedParams(originalURL, result.FinalQuery)
+	}
+	if warnHops > 0 && len(hops) > warnHops {
+		result.LongChain = true
+	}
+	if sanitize {
+		sanitizeResult(&result)
+	}
+	if len(hops) > 0 && hops[len(hops)-1].UnexpectedType {
+		result.UnexpectedType = true
+	}
+	if len(hops) > 0 && hops[len(hops)-1].UnexpectedFinal {
+		result.UnexpectedFinal = true
+	}
+	result.InsecureHopDetected = slices.ContainsFunc(hops, func(hop Hop) bool { return hop.Insecure })
+	for _, hop := range hops {
+		result.BytesSent += hop.BytesSent
+		result.BytesReceived += hop.BytesReceived
+	}
+	if len(hops) > 0 && hops[len(hops)-1].location != "" {
+		result.WouldRedirectTo = hops[len(hops)-1].location
+		if sanitize {
+			result.WouldRedirectTo = redactURL(result.WouldRedirectTo)
 		}
+	}
 
-	case viewOption == "verbose":
-		if len(redirectURL) <= outputWidth {
-			outputDividerWidth = len(redirectURL) + 15
+	return result
+}
+
+// uniqueHosts lists the distinct hostnames the hops visited, lowercased, in the order they were first seen
+func uniqueHosts(hops []Hop) []string {
+	var hosts []string
+	for _, hop := range hops {
+		host := strings.ToLower(hostOf(hop.URL))
+		if host != "" && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
 		}
+	}
+	return hosts
+}
 
-		fmt.Printf("\n\t%sHop%s | %sStatus%s | %sURL%s\n", boldBlue, reset, boldBlue, reset, boldBlue, reset)
-		fmt.Printf("\t%s", strings.Repeat("-", outputDividerWidth))
+// cycleRepeats is how many times over a chain has to go round the same hosts to be called a loop
+const cycleRepeats = 3
 
-		// Print each hop
-		for _, hop := range hops {
-			fmt.Fprintf(
-				os.Stdout,
-				"\n\t%s%-3d%s | %-6d | %s\n\t%s\n",
-				brightCyan,
-				hop.Number,
-				reset,
-				hop.StatusCode,
-				formatURL(hop.URL),
-				strings.Repeat("-", outputDividerWidth),
-			)
+// hostCycle returns the hosts the end of hosts keeps going round (A, B, C for ... A, B, C, A, B, C, A, B, C),
+// when the same cycle of two or more hosts makes up the last repeats stretches of it; otherwise nil.
+// Redirects within one host aren't a cycle: sites do that legitimately.
+func hostCycle(hosts []string, repeats int) []string {
+	for period := 2; period*repeats <= len(hosts); period++ {
+		tail := hosts[len(hosts)-period*repeats:]
+		cycling := true
+		for i := period; i < len(tail) && cycling; i++ {
+			cycling = tail[i] == tail[i-period]
+		}
+		if !cycling {
+			continue
+		}
+		cycle := slices.Clone(tail[:period])
+		if slices.ContainsFunc(cycle, func(host string) bool { return host != cycle[0] }) {
+			return cycle
 		}
+	}
+	return nil
+}
 
-		// Print additional information
-		fmt.Fprintf(os.Stdout, "\n\t%sFinal URL%s:     %s\n", boldBlue, reset, formatURL(redirectURL))
+// hostChanges counts the hops whose host differs from the hop before's
+func hostChanges(hops []Hop) int {
+	changes := 0
+	for i := 1; i < len(hops); i++ {
+		if !strings.EqualFold(hostOf(hops[i].URL), hostOf(hops[i-1].URL)) {
+			changes++
+		}
+	}
+	return changes
+}
 
-		if cleanedURL != redirectURL {
-			fmt.Fprintf(os.Stdout, "\n\t%sClean URL%s:     %s\n", green, reset, cleanedURL)
+// addedParams lists, sorted, the query parameters in finalQuery that originalURL didn't have:
+// whatever the chain tacked on along the way (utm_source, fbclid and the like)
+func addedParams(originalURL string, finalQuery url.Values) []string {
+	var original url.Values
+	if u, err := url.Parse(originalURL); err == nil {
+		original = u.Query()
+	}
+
+	var added []string
+	for name := range finalQuery {
+		if !original.Has(name) {
+			added = append(added, name)
 		}
+	}
+	slices.Sort(added)
+	return added
+}
+
+// printWarnings prints a warning to stderr for each thing flagged on the result: a long chain, an unexpected content type
+// or final URL, a plain http hop
+func printWarnings(result TraceResult) {
+	if result.LongChain {
+		fmt.Fprintf(os.Stderr, "Warning: %s took %d hops (more than %d)\n", result.OriginalURL, len(result.Hops), warnHops)
+	}
+	if result.UnexpectedType && result.Error == "" {
+		landing := result.Hops[len(result.Hops)-1]
+		fmt.Fprintf(os.Stderr, "Warning: %s landed on an unexpected content type (%q)\n", result.OriginalURL, landing.ContentType)
+	}
+	if result.UnexpectedFinal && result.Error == "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s landed somewhere -expect-final doesn't allow (%s)\n", result.OriginalURL, result.FinalURL)
+	}
+	if result.InsecureHopDetected && result.Error == "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s went over plain http\n", result.OriginalURL)
+	}
+}
+
+// logTraceError sends a failed trace to opts.Logger, if there is one
+func logTraceError(opts TraceOptions, url string, err error) {
+	if opts.Logger != nil && err != nil {
+		opts.Logger.Error("trace failed", "url", redactURL(url), "error", err.Error())
+	}
+}
 
-		fmt.Printf("\t%s\n", strings.Repeat("-", outputDividerWidth))
+// handleTraceError reports a failed single-URL trace and exits
+func handleTraceError(w io.Writer, err error) {
+	switch {
+	case errors.Is(err, ErrCloudflare):
+		doCloudFlareError(w)
+	case errors.Is(err, ErrConnectionRefused):
+		doConnectionRefusedError(w)
+	case errors.Is(err, ErrTimeout):
+		doTimeout(w)
+	case errors.Is(err, ErrCertValidation):
+		doValidationError(w)
 	}
 
+	fmt.Fprintf(w, "Error tracing URL: %s\n", redactText(err.Error()))
+	os.Exit(1)
 }
 
-// Tracer Functions
+// printBatchResult prints one result of a batch run in the chosen view, returning printTraceResult's error
+func printBatchResult(w io.Writer, result TraceResult, viewOption string) error {
+	if result.Error != "" {
+		fmt.Fprintf(os.Stderr, "Error tracing %s: %s\n", result.OriginalURL, result.Error)
+		return nil
+	}
 
-func doCloudFlareError() {
-	fmt.Println("\nCloudflare protection prevents tracing. Sorry!")
-	os.Exit(0)
+	if decoratedView(viewOption) {
+		fmt.Fprintf(w, "\n%sURL%s:           %s\n", bold, reset, formatURL(result.OriginalURL))
+	}
+
+	return printTraceResult(w, result, viewOption)
 }
 
-func doConnectionRefusedError() {
-	fmt.Println("\nThe connection was refused (possibly because of DNS). Sorry!")
-	os.Exit(0)
+// progress shows how far a batch run has got, on stderr
+// It only draws when stderr is a terminal, and at most once per progressInterval.
+type progress struct {
+	total   int
+	enabled bool
+	last    time.Time
 }
 
-func doTimeout() {
-	fmt.Println("\nThe request timed out. Sorry!")
-	os.Exit(0)
+const progressInterval = 200 * time.Millisecond
+
+func newProgress(total int) *progress {
+	return &progress{
+		total:   total,
+		enabled: !quiet && isTerminal(os.Stderr),
+	}
 }
 
-func doValidationError() {
-	fmt.Println("\nThere was a certification validation error. Sorry!")
-	os.Exit(0)
+func (p *progress) update(done int) {
+	if !p.enabled || (done < p.total && time.Since(p.last) < progressInterval) {
+		return
+	}
+	p.last = time.Now()
+	fmt.Fprintf(os.Stderr, "\r\033[Ktracing %d/%d...", done, p.total)
 }
 
-func followRedirects(urlStr string) (string, []Hop, bool, error) {
-	// CF didn't break anything yet.
-	cloudflareStatus := false // Defaults to false
+// clear wipes the progress line so other output doesn't run into it
+func (p *progress) clear() {
+	if p.enabled {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
 
-	hops := []Hop{}
-	number := 1
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
 
-	var previousURL *url.URL
+// terminalURLWidth works out a URL tab width that fits stdout's terminal
+// ok is false when stdout isn't a terminal or its size can't be read.
+func terminalURLWidth() (int, bool) {
+	if !isTerminal(os.Stdout) {
+		return 0, false
+	}
 
-	// Use a set to keep track of visited URLs
-	visitedURLs := make(map[string]int)
+	columns, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || columns <= 0 {
+		return 0, false
+	}
 
-	// Ensure the initial URL is marked as visited
-	visitedURLs[urlStr] = 1
+	// Leave room for the tab and "Hop | Status | " column in front of verbose URLs
+	return max(columns-23, 20), true
+}
 
-	for {
-		// Check if the URL has been visited before
-		if visitedURLs[urlStr] > 1 {
-			// Redirect loop detected
-			hops = append(hops, Hop{
-				Number:     number,
-				URL:        urlStr,
-				StatusCode: http.StatusLoopDetected,
-			})
-			return urlStr, hops, cloudflareStatus, nil
-		} else {
-			visitedURLs[urlStr]++
+// compareUserAgents traces urlStr once as opts.UserAgent and once as otherUA, and reports cloaking
+// when the two chains land on different (clean) URLs. A trace that fails has its error in its own result,
+// and the two are only compared when both got to a final URL.
+func compareUserAgents(ctx context.Context, w io.Writer, urlStr string, opts TraceOptions, otherUA string, outputJSON bool, viewOption string) int {
+	otherOpts := opts
+	otherOpts.UserAgent = otherUA
+	// -H User-Agent would override both traces, which defeats the point, so it only applies to the first
+	if opts.Headers.Get("User-Agent") != "" {
+		otherOpts.Headers = opts.Headers.Clone()
+		otherOpts.Headers.Del("User-Agent")
+	}
+
+	comparison := UAComparison{SchemaVersion: schemaVersion}
+	for _, o := range []TraceOptions{opts, otherOpts} {
+		redirectURL, hops, err := followRedirects(ctx, urlStr, o)
+		logTraceError(o, urlStr, err)
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(w, "\nTrace interrupted.")
+			return 130
 		}
 
-		req, err := http.NewRequest("GET", urlStr, nil)
+		userAgent := o.Headers.Get("User-Agent")
+		if userAgent == "" {
+			userAgent = o.UserAgent
+		}
+		if userAgent == "" {
+			userAgent = defaultUserAgent
+		}
+		result := newTraceResult(urlStr, redirectURL, hops)
 		if err != nil {
-			return "", nil, cloudflareStatus, fmt.Errorf("error creating request: %s", err)
+			result.Error = redactText(err.Error())
 		}
+		comparison.Traces = append(comparison.Traces, UATrace{UserAgent: userAgent, Result: result})
+	}
 
-		// Set the user agent header
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+	first, second := comparison.Traces[0].Result, comparison.Traces[1].Result
+	compared := first.CleanURL != "" && second.CleanURL != ""
+	comparison.Cloaking = compared && first.CleanURL != second.CleanURL
 
-		resp, err := client.Do(req)
-		if err != nil {
-			if strings.Contains(err.Error(), "connection refused") {
-				doConnectionRefusedError()
-				return "", nil, cloudflareStatus, nil
-			}
+	exitCode := 0
+	if first.Error != "" || second.Error != "" {
+		exitCode = 1
+	}
 
-			if err, ok := err.(*url.Error); ok && err.Timeout() {
-				doTimeout()
-				return "", nil, cloudflareStatus, nil
-			}
+	if outputJSON {
+		outputAsJSON(comparison)
+		return exitCode
+	}
 
-			if strings.Contains(err.Error(), "x509: certificate signed by unknown authority") {
-				// Handle certificate verification error
-				doValidationError()
-				return "", nil, cloudflareStatus, nil
+	if decoratedView(viewOption) {
+		ClearTerminal(w)
+	}
+	for _, trace := range comparison.Traces {
+		fmt.Fprintf(w, "\n%sUser-Agent%s:    %s\n", bold, reset, trace.UserAgent)
+		// Like a batch, a trace with no chain to show is just its error
+		if len(trace.Result.Hops) > 0 {
+			if err := printTraceResult(w, trace.Result, viewOption); err != nil {
+				exitCode = 1
 			}
+		}
+		if trace.Result.Error != "" {
+			fmt.Fprintf(os.Stderr, "\nError tracing URL: %s\n", trace.Result.Error)
+		}
+	}
 
-			// Close response body in case of error
-			if resp != nil && resp.Body != nil {
-				resp.Body.Close()
-			}
+	if !compared {
+		fmt.Fprintf(w, "\n%sNot compared%s: both User-Agents need to get to a final URL\n", yellow, reset)
+	} else if comparison.Cloaking {
+		fmt.Fprintf(w, "\n%sCloaking detected%s: the two User-Agents end up at different URLs\n", red, reset)
+	} else {
+		fmt.Fprintf(w, "\n%sNo cloaking%s: both User-Agents end up at the same URL\n", green, reset)
+	}
+	return exitCode
+}
+
+// BatchOptions controls how a batch run is output
+type BatchOptions struct {
+	OutputJSON bool
+	ViewOption string
+	// SortBy is one of batchSorts
+	SortBy string
+	// NoCache traces every URL, even ones already traced earlier in the run
+	NoCache bool
+	// OTel sends the run to an OpenTelemetry collector, a trace per URL
+	OTel bool
+	// Syslog, if set, is the syslog server each result is summarized to
+	Syslog string
+	// HARPath, if set, is where to write the run as a HAR file; "-" writes it to stdout in place of the usual output
+	HARPath string
+	// GroupByFinal outputs the results grouped by the host they ended at, biggest group first
+	GroupByFinal bool
+	// Out is where text results go, stdout when nil (-trace-to-stderr sends them to stderr)
+	Out io.Writer
+}
+
+// GroupedResults is the JSON output of -group-by-final: the batch's results, grouped by the host they ended on
+type GroupedResults struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	Groups        []ResultGroup `json:"groups"`
+}
+
+// ResultGroup is the batch results that ended on one host, for -group-by-final
+type ResultGroup struct {
+	Host    string        `json:"host"`
+	Count   int           `json:"count"`
+	Results []TraceResult `json:"results"`
+}
+
+// groupByFinalHost groups results by their final URL's host, biggest group first (ties by host).
+// Results keep their order within a group; those with no final URL are grouped under "".
+func groupByFinalHost(results []TraceResult) []ResultGroup {
+	var groups []ResultGroup
+	index := make(map[string]int)
+	for _, result := range results {
+		host := strings.ToLower(hostOf(result.FinalURL))
+		i, ok := index[host]
+		if !ok {
+			i = len(groups)
+			index[host] = i
+			groups = append(groups, ResultGroup{Host: host})
+		}
+		groups[i].Results = append(groups[i].Results, result)
+		groups[i].Count++
+	}
+
+	slices.SortStableFunc(groups, func(a, b ResultGroup) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Host, b.Host))
+	})
+	return groups
+}
+
+// Rate-limited batch URLs are put off while their host cools down: for as long as its Retry-After asks
+// (or defaultCooldown without one), at most maxRateLimitRetries times, and not when the wait is over maxCooldown
+const (
+	defaultCooldown     = 30 * time.Second
+	maxCooldown         = 5 * time.Minute
+	maxRateLimitRetries = 3
+)
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as an HTTP date, as a wait from now.
+// It's 0 when the header is missing or can't be read.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return max(when.Sub(now), 0)
+	}
+	return 0
+}
+
+// batchItem is a URL waiting its turn in a batch, with where it came in the list
+type batchItem struct {
+	index    int
+	url      string
+	attempts int
+	// waitFor is the host that rate-limited its last attempt, if any
+	waitFor string
+}
+
+// cachedTrace is a finished trace kept for later duplicates in a batch
+type cachedTrace struct {
+	result TraceResult
+	err    error
+}
 
-			return "", nil, cloudflareStatus, fmt.Errorf("error accessing URL: %s", err)
-		}
+// runBatch traces each URL in turn and returns the exit code
+// Text results print as each trace completes (unless SortBy asks for an order other than "input",
+// which has to wait for the whole run); JSON results print together at the end.
+// A URL that's already been traced in this run (compared in canonical form) reuses the earlier result.
+// If ctx is cancelled, the in-flight trace is dropped and completed results are still output.
+// A URL whose host answers 429 is put off, and the URLs behind it go ahead, until the host has cooled
+// down; other URLs for that host wait too. Put-off results print late, but sort back into place otherwise.
+func runBatch(ctx context.Context, urls []string, opts TraceOptions, batchOpts BatchOptions) int {
+	viewOption := batchOpts.ViewOption
+	out := batchOpts.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	results := []TraceResult{}
+	order := []int{}
+	harOnly := batchOpts.HARPath == "-"
+	printAsWeGo := !batchOpts.OutputJSON && viewOption != "dot" && batchOpts.SortBy == "input" && !harOnly && !batchOpts.GroupByFinal
+	badStatus := false
+	cache := make(map[string]cachedTrace)
+	cacheHits := 0
+	prog := newProgress(len(urls))
+	prog.update(0)
 
-		if resp != nil && resp.Body != nil {
-			defer resp.Body.Close()
+	queue := make([]batchItem, len(urls))
+	for i, u := range urls {
+		queue[i] = batchItem{index: i, url: u}
+	}
+	cooldowns := make(map[string]time.Time)
+	// coolsAt is when item can go ahead: once both its own host and the one that last rate-limited it have cooled down
+	coolsAt := func(item batchItem) time.Time {
+		until := cooldowns[strings.ToLower(hostOf(item.url))]
+		if waitFor := cooldowns[item.waitFor]; waitFor.After(until) {
+			until = waitFor
 		}
+		return until
+	}
 
-		hop := Hop{
-			Number:     number,
-			URL:        urlStr,
-			StatusCode: resp.StatusCode,
+	for len(queue) > 0 {
+		if ctx.Err() != nil {
+			break
 		}
-		hops = append(hops, hop)
 
-		if resp.StatusCode >= 300 && resp.StatusCode <= 399 {
-			location := resp.Header.Get("Location")
-			if location == "" {
-				if strings.Contains(resp.Header.Get("Server"), "cloudflare") {
-					cloudflareStatus = true
+		// Take the first URL whose hosts aren't cooling down; if they all are, wait for the soonest
+		next := 0
+		for next < len(queue) && coolsAt(queue[next]).After(time.Now()) {
+			next++
+		}
+		if next == len(queue) {
+			next = 0
+			for i := range queue {
+				if coolsAt(queue[i]).Before(coolsAt(queue[next])) {
+					next = i
 				}
-				return "", []Hop{}, cloudflareStatus, nil // Return empty slice of Hop when redirect location is not found
 			}
-			if strings.HasPrefix(location, "https://outlook.office365.com") {
-				// Only include the final request as the last hop
-				finalHop := Hop{
-					Number:     number + 2, // Increment the hop number for the final request
-					URL:        location,
-					StatusCode: http.StatusOK, // Set the status code to 200 for the final request
-				}
-				hops = append(hops, finalHop)
-
-				return location, hops, cloudflareStatus, nil
+			prog.clear()
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "Rate limited: waiting until %s...\n", coolsAt(queue[next]).Format(time.TimeOnly))
+			}
+			select {
+			case <-time.After(time.Until(coolsAt(queue[next]))):
+			case <-ctx.Done():
+				continue
 			}
+		}
+		item := queue[next]
+		queue = slices.Delete(queue, next, next+1)
+		u := item.url
 
-			redirectURL, err := handleRelativeRedirect(previousURL, location, req.URL)
-			if err != nil {
-				return "", nil, cloudflareStatus, fmt.Errorf("error handling relative redirect: %s", err)
+		key := canonicalURL(u)
+		cached, hit := cache[key]
+		if hit && !batchOpts.NoCache {
+			cacheHits++
+			cached.result.OriginalURL = redactURL(u)
+			cached.result.Cached = true
+		} else {
+			redirectURL, hops, err := followRedirects(ctx, u, opts)
+			if errors.Is(err, context.Canceled) {
+				logTraceError(opts, u, err)
+				break
 			}
 
-			// Convert redirectURL to a string
-			redirectURLString := redirectURL.String()
+			// A 429 puts its host on a cooldown, and this URL back in the queue to try again after it
+			if last := len(hops) - 1; last >= 0 && hops[last].StatusCode == http.StatusTooManyRequests && item.attempts < maxRateLimitRetries {
+				wait := cmp.Or(hops[last].retryAfter, defaultCooldown)
+				if wait <= maxCooldown {
+					host := strings.ToLower(hostOf(hops[last].URL))
+					cooldowns[host] = time.Now().Add(wait)
+					if opts.Logger != nil {
+						opts.Logger.Warn("rate limited", "url", redactURL(u), "host", host, "wait", wait.String())
+					}
+					item.attempts++
+					item.waitFor = host
+					queue = append(queue, item)
+					continue
+				}
+			}
+			logTraceError(opts, u, err)
 
-			// Check if the "returnUri" query parameter is present
-			u, err := url.Parse(redirectURLString)
+			cached = cachedTrace{result: newTraceResult(u, redirectURL, hops), err: err}
 			if err != nil {
-				return "", nil, cloudflareStatus, fmt.Errorf("error parsing URL: %s", err)
+				cached.result.Error = redactText(err.Error())
 			}
-			queryParams := u.Query()
-			if returnURI := queryParams.Get("returnUri"); returnURI != "" {
-				decodedReturnURI, err := url.PathUnescape(returnURI)
-				if err != nil {
-					return "", nil, cloudflareStatus, fmt.Errorf("error decoding returnUri: %s", err)
-				}
-				decodedReturnURI = strings.ReplaceAll(decodedReturnURI, "%3A", ":")
-				decodedReturnURI = strings.ReplaceAll(decodedReturnURI, "%2F", "/")
+			cache[key] = cached
+		}
+
+		result, err := cached.result, cached.err
+		if keepsResult(err) {
+			badStatus = true
+		}
+		if _, ok := nthHop(result.Hops, selectedHop); viewOption == "hop" && !ok {
+			badStatus = true
+		}
+		results = append(results, result)
+		order = append(order, item.index)
 
-				redirectURLString = u.Scheme + "://" + u.Host + u.Path + "?returnUri=" + decodedReturnURI
+		prog.clear()
+		if printAsWeGo {
+			if err := printBatchResult(out, result, viewOption); err != nil {
+				badStatus = true
 			}
+			printWarnings(result)
+		}
+		prog.update(len(results))
+	}
+	prog.clear()
 
-			if redirURI := queryParams.Get("redir"); redirURI != "" {
-				decodedRedirURI, err := url.PathUnescape(redirURI)
-				if err != nil {
-					return "", nil, cloudflareStatus, fmt.Errorf("error decoding redir param: %s", err)
+	if !printAsWeGo {
+		// Back into input order first, in case any were put off by a rate limit
+		positions := make([]int, len(results))
+		for i := range positions {
+			positions[i] = i
+		}
+		slices.SortFunc(positions, func(a, b int) int { return cmp.Compare(order[a], order[b]) })
+		inputOrder := make([]TraceResult, len(results))
+		for i, position := range positions {
+			inputOrder[i] = results[position]
+		}
+		results = inputOrder
+		sortResults(results, batchOpts.SortBy)
+		if batchOpts.GroupByFinal && !batchOpts.OutputJSON && !harOnly {
+			for _, group := range groupByFinalHost(results) {
+				noun := "URLs"
+				if group.Count == 1 {
+					noun = "URL"
+				}
+				fmt.Fprintf(out, "\n%s%s%s: %d %s\n", boldBlue, cmp.Or(group.Host, "(no final URL)"), reset, group.Count, noun)
+				for _, result := range group.Results {
+					if err := printBatchResult(out, result, viewOption); err != nil {
+						badStatus = true
+					}
+					printWarnings(result)
 				}
-				decodedRedirURI = strings.ReplaceAll(decodedRedirURI, "%3A", ":")
-				decodedRedirURI = strings.ReplaceAll(decodedRedirURI, "%2F", "/")
-
-				redirectURLString = u.Scheme + "://" + u.Host + u.Path + "?redir=" + decodedRedirURI
 			}
-
-			urlStr = redirectURLString
-			number++
-
-			previousURL, err = url.Parse(urlStr)
-			if err != nil {
-				return "", nil, cloudflareStatus, fmt.Errorf("error parsing URL: %s", err)
+		} else {
+			for _, result := range results {
+				if !batchOpts.OutputJSON && viewOption != "dot" && !harOnly {
+					if err := printBatchResult(out, result, viewOption); err != nil {
+						badStatus = true
+					}
+				}
+				printWarnings(result)
 			}
-			continue
 		}
+	}
 
-		return urlStr, hops, cloudflareStatus, nil
+	if batchOpts.HARPath != "" {
+		if err := writeHAR(batchOpts.HARPath, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing HAR: %s\n", err)
+		}
+	}
+	if batchOpts.OTel {
+		if err := exportOTLP(results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending spans to the OpenTelemetry collector: %s\n", err)
+		}
+	}
+	if batchOpts.Syslog != "" {
+		if err := sendSyslog(batchOpts.Syslog, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending results to syslog at %s: %s\n", batchOpts.Syslog, err)
+		}
 	}
-}
 
-func handleRelativeRedirect(previousURL *url.URL, location string, requestURL *url.URL) (*url.URL, error) {
-	redirectURL, err := url.Parse(location)
-	if err != nil {
-		log.Printf("Error parsing redirect URL: %v", err)
-		return nil, err
+	if harOnly {
+		// The HAR is the output
+	} else if batchOpts.OutputJSON && batchOpts.GroupByFinal {
+		outputAsJSON(GroupedResults{SchemaVersion: schemaVersion, Groups: groupByFinalHost(results)})
+	} else if batchOpts.OutputJSON {
+		outputAsJSON(results)
+	} else if viewOption == "dot" {
+		// One combined graph, so chains that converge share their nodes
+		writeDOT(out, results)
 	}
 
-	if redirectURL.Scheme == "" {
-		// If the scheme is missing, set it to the scheme of the previous URL or the request URL
-		if previousURL != nil {
-			redirectURL.Scheme = previousURL.Scheme
-		} else if requestURL != nil {
-			redirectURL.Scheme = requestURL.Scheme
-		} else {
-			return nil, errors.New("missing scheme for relative redirect")
-		}
+	if cacheHits > 0 && !quiet {
+		fmt.Fprintf(os.Stderr, "\n%d of %d URLs were repeats and reused an earlier trace (-no-cache to trace them all).\n", cacheHits, len(results))
 	}
 
-	if redirectURL.Host == "" {
-		// If the host is missing, set it to the host of the previous URL or the request URL
-		if previousURL != nil {
-			redirectURL.Host = previousURL.Host
-		} else if requestURL != nil {
-			redirectURL.Host = requestURL.Host
-		} else {
-			return nil, errors.New("missing host for relative redirect")
+	if ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "\nInterrupted after %d of %d URLs.\n", len(results), len(urls))
+		return 130
+	}
+
+	if badStatus {
+		return 1
+	}
+	return 0
+}
+
+// batchSorts are the orders -sort accepts
+var batchSorts = []string{"input", "hops", "status", "final"}
+
+// sortResults orders a batch's results: "hops" puts the longest chains first, "status" groups them
+// by final status code, and "final" sorts by final URL. Ties (and "input") keep the input order.
+func sortResults(results []TraceResult, sortBy string) {
+	finalStatus := func(r TraceResult) int {
+		if len(r.Hops) == 0 {
+			return 0
 		}
+		return r.Hops[len(r.Hops)-1].StatusCode
 	}
 
-	return redirectURL, nil
+	sort.SliceStable(results, func(i, j int) bool {
+		switch sortBy {
+		case "hops":
+			return len(results[i].Hops) > len(results[j].Hops)
+		case "status":
+			return finalStatus(results[i]) < finalStatus(results[j])
+		case "final":
+			return results[i].FinalURL < results[j].FinalURL
+		}
+		return false
+	})
 }
 
 func main() {
 	// Parse command-line arguments
 	var (
-		flagHelp       bool
-		flagOutputJSON bool
-		flagTerse      bool
-		flagVerbose    bool
-		flagWidth      int
+		flagAllowDowngradeOnce bool
+		flagArrow              bool
+		flagArrowHosts         bool
+		flagB64Params          string
+		flagBase               string
+		flagBrowser            bool
+		flagBytes              bool
+		flagCACert             string
+		flagCanonical          bool
+		flagCert               string
+		flagCompact            bool
+		flagCompareUA          string
+		flagContentType        string
+		flagCookieJar          string
+		flagCount              bool
+		flagData               string
+		flagExpectFinal        stringList
+		flagExpectType         string
+		flagFailOnError        bool
+		flagDOT                bool
+		flagFile               string
+		flagFileJSON           string
+		flagFollowCodes        string
+		flagGroupByFinal       bool
+		flagHAR                string
+		flagHeadThenGet        bool
+		flagHeaders            stringList
+		flagHelp               bool
+		flagHop                int
+		flagHopTimeout         time.Duration
+		flagHostCount          bool
+		flagHTTP3              bool
+		flagInteractive        bool
+		flagInteresting        bool
+		flagInterface          string
+		flagKey                string
+		flagLang               string
+		flagListHops           bool
+		flagLogJSON            bool
+		flagMaxBody            int64
+		flagMeta               bool
+		flagMaxHops            int
+		flagMaxHostChanges     int
+		flagMaxPerHost         int
+		flagMaxTotalBytes      int64
+		flagMethod             string
+		flagNetrc              bool
+		flagNoBody             bool
+		flagNoCache            bool
+		flagNoColor            bool
+		flagNoDowngrade        bool
+		flagNoKeepAlive        bool
+		flagNoUnwrap           bool
+		flagNormalizeEncoding  bool
+		flagPeek               bool
+		flagOTel               bool
+		flagOutputJSON         bool
+		flagProfile            string
+		flagProxy              string
+		flagQuiet              bool
+		flagRecord             string
+		flagReplay             string
+		flagRequireHTTPS       bool
+		flagResolve            stringList
+		flagSameOrigin         bool
+		flagSanitize           bool
+		flagSaveBody           string
+		flagSort               string
+		flagSortQuery          bool
+		flagStopOnTracking     bool
+		flagStream             bool
+		flagSyslog             string
+		flagTemplate           string
+		flagTerse              bool
+		flagTimestamps         bool
+		flagTraceToStderr      bool
+		flagTLSCiphers         string
+		flagTLSMin             string
+		flagTrimSlash          bool
+		flagTSV                bool
+		flagTSVHeader          bool
+		flagUA                 string
+		flagURLDeadline        time.Duration
+		flagUser               string
+		flagVerbose            bool
+		flagWarnHops           int
+		flagWidth              int
 	)
 
+	flag.BoolVar(&flagAllowDowngradeOnce, "allow-downgrade-once", false, "Allow one https -> http redirect mid-chain")
+	flag.BoolVar(&flagArrow, "arrow", false, "Output the chain on one line, its URLs joined with ->")
+	flag.BoolVar(&flagArrowHosts, "arrow-hosts", false, "Like -arrow, with just the hosts")
+	flag.StringVar(&flagB64Params, "b64-params", "", "Comma-separated query params that may hold a base64-encoded redirect URL")
+	flag.StringVar(&flagBase, "base", "", "Resolve the URLs given (or read with -f) against this URL, so they can be paths like /a")
+	flag.BoolVar(&flagBrowser, "browser", false, "Send the full set of headers a desktop browser sends, not just its User-Agent")
+	flag.BoolVar(&flagBytes, "bytes", false, "Show roughly how many bytes each hop sent and received, in verbose output")
+	flag.StringVar(&flagCACert, "cacert", "", "Also trust the CA certificates in this PEM file")
+	flag.BoolVar(&flagCanonical, "canonical", false, "Also output a canonical form of the clean URL")
+	flag.BoolVar(&flagCompact, "compact", false, "Output JSON on a single line (implies -j)")
+	flag.StringVar(&flagCert, "cert", "", "Client certificate (PEM) for servers that require mutual TLS")
+	flag.StringVar(&flagCompareUA, "compare-ua", "", "Trace again with this User-Agent and flag a different destination")
+	flag.StringVar(&flagContentType, "content-type", "", "Content-Type sent with -data")
+	flag.BoolVar(&flagDOT, "dot", false, "Output the chain as a Graphviz DOT graph")
+	flag.StringVar(&flagCookieJar, "cookie-jar", "", "Load cookies from, and save them to, a Netscape-format file")
+	flag.BoolVar(&flagCount, "count", false, "Output only the number of redirects")
+	flag.StringVar(&flagData, "data", "", "Body to send with the first request")
+	flag.Var(&flagExpectFinal, "expect-final", "Host or URL pattern the chain should end at (repeatable, * matches anything)")
+	flag.StringVar(&flagExpectType, "expect-type", "", "Comma-separated media types the final response should have (e.g. image/*,application/pdf)")
+	flag.BoolVar(&flagFailOnError, "fail-on-error", false, "Exit nonzero when the final response isn't 2xx")
+	flag.StringVar(&flagFile, "f", "", "Read URLs to trace from a file, one per line (- for stdin)")
+	flag.StringVar(&flagFileJSON, "fj", "", "Read URLs to trace from a JSON array (- for stdin)")
+	flag.StringVar(&flagFollowCodes, "follow-codes", "", "Comma-separated redirect codes to follow (default: 301,302,303,307,308)")
+	flag.BoolVar(&flagGroupByFinal, "group-by-final", false, "In batch mode, group the results by the host they end at")
+	flag.StringVar(&flagHAR, "har", "", "Write the trace as a HAR (HTTP Archive) file (- for stdout)")
+	flag.BoolVar(&flagHeadThenGet, "head-then-get", false, "Try HEAD on each hop, falling back to GET when no Location comes back")
+	flag.Var(&flagHeaders, "H", "Extra request header, as \"Name: value\" (repeatable)")
 	flag.BoolVar(&flagHelp, "h", false, "Show help message")
 	flag.BoolVar(&flagHelp, "help", false, "Show help message")
+	flag.IntVar(&flagHop, "hop", 0, "Output only the Nth hop's URL (negative counts from the end, -1 is the last)")
+	flag.DurationVar(&flagHopTimeout, "hop-timeout", 0, "Maximum time for any one hop (e.g. 2s); a slow hop that already sent its Location is still followed")
+	flag.BoolVar(&flagHostCount, "host-count", false, "Output only the number of distinct hosts in the chain")
+	flag.BoolVar(&flagHTTP3, "http3", false, "Try HTTP/3 first, falling back to TCP")
+	flag.BoolVar(&flagInteractive, "i", false, "Pause for Enter before following each redirect")
+	flag.StringVar(&flagInterface, "interface", "", "Send requests from this local IP address or network interface")
+	flag.BoolVar(&flagInteresting, "interesting", false, "In verbose output, fold runs of same-host redirects into one line")
 	flag.BoolVar(&flagOutputJSON, "j", false, "Output results as JSON")
+	flag.StringVar(&flagKey, "key", "", "Private key (PEM) for -cert, if it isn't in the same file")
+	flag.StringVar(&flagLang, "lang", "", "Send Accept-Language with this value (e.g. de-DE)")
+	flag.BoolVar(&flagListHops, "list-hops", false, "Output each hop's URL on its own line")
+	flag.BoolVar(&flagLogJSON, "log-json", false, "Log each hop, redirect and error to stderr as JSON lines")
+	flag.Int64Var(&flagMaxBody, "max-body", 10<<20, "Read at most this many bytes of a response body (0 for no limit)")
+	flag.IntVar(&flagMaxHops, "max-hops", 20, "Give up after this many hops (0 for no limit)")
+	flag.IntVar(&flagMaxHostChanges, "max-host-changes", 0, "Stop after the chain has changed host this many times (0 for no limit)")
+	flag.IntVar(&flagMaxPerHost, "max-per-host", 0, "Declare a loop once any host is visited more than N times")
+	flag.Int64Var(&flagMaxTotalBytes, "max-total-bytes", 0, "Stop once this many body bytes have been read across the whole chain (0 for no limit)")
+	flag.BoolVar(&flagMeta, "meta", false, "Flag 3xx pages whose <meta http-equiv=\"refresh\"> disagrees with their Location")
+	flag.StringVar(&flagMethod, "method", "", "HTTP method for the first request (default GET, or POST with -data)")
+	flag.BoolVar(&flagNetrc, "netrc", false, "Send Basic Auth from ~/.netrc to matching hosts")
+	flag.BoolVar(&flagNoBody, "no-body", false, "Close every response without reading its body")
+	flag.BoolVar(&flagNoCache, "no-cache", false, "In batch mode, trace repeated URLs again instead of reusing the result")
+	flag.BoolVar(&flagNoColor, "no-color", false, "Turn off colors in the output")
+	flag.BoolVar(&flagNoDowngrade, "no-downgrade", false, "Abort if a redirect goes from https to http")
+	flag.BoolVar(&flagNoKeepAlive, "no-keepalive", false, "Use a fresh connection for every request")
+	flag.BoolVar(&flagNoUnwrap, "no-unwrap", false, "Follow Location exactly, without unwrapping returnUri/redir params")
+	flag.BoolVar(&flagNormalizeEncoding, "normalize-encoding", false, "Percent-encode the final URL one consistent way")
+	flag.BoolVar(&flagOTel, "otel", false, "Send the trace to an OpenTelemetry collector (OTEL_EXPORTER_OTLP_ENDPOINT) as spans")
+	flag.BoolVar(&flagPeek, "peek", false, "Make only the first request, and show where it would redirect to")
+	flag.StringVar(&flagProfile, "profile", "", "Use the flags in this profile from the config file")
+	flag.StringVar(&flagProxy, "proxy", "", "Send requests through this proxy (http://, https:// or socks5://)")
+	flag.BoolVar(&flagQuiet, "quiet", false, "Hide the progress indicator in batch mode")
+	flag.StringVar(&flagRecord, "record", "", "Save every request and response to this directory, for -replay")
+	flag.StringVar(&flagReplay, "replay", "", "Answer requests from what -record saved in this directory, instead of the network")
+	flag.BoolVar(&flagRequireHTTPS, "require-https", false, "Flag any hop fetched over plain http (an error with -fail-on-error)")
+	flag.Var(&flagResolve, "resolve", "Force a host to resolve to an IP (host:ip or host:port:ip, repeatable)")
 	flag.BoolVar(&flagTerse, "s", false, "Output only the final/clean url")
+	flag.BoolVar(&flagSameOrigin, "same-origin", false, "Stop at the first redirect that leaves the starting origin")
+	flag.BoolVar(&flagSanitize, "sanitize", false, "Mask logins and sensitive query values in the output")
+	flag.StringVar(&flagSaveBody, "save-body", "", "Write the final response body to this file")
+	flag.StringVar(&flagSort, "sort", "input", "Order of batch results: input, hops, status or final")
+	flag.BoolVar(&flagSortQuery, "sort-query", false, "Sort the clean URL's query parameters alphabetically")
+	flag.BoolVar(&flagStopOnTracking, "stop-on-tracking", false, "Stop at the first redirect that adds a tracking parameter")
+	flag.BoolVar(&flagStream, "stream", false, "Print each hop as soon as it's fetched, instead of all at the end")
+	flag.StringVar(&flagSyslog, "syslog", "", "Send a summary of each trace to this syslog server (udp://host:514 or tcp://host:601)")
+	flag.StringVar(&flagTemplate, "template", "", "Format each result with a Go text/template")
+	flag.BoolVar(&flagTimestamps, "timestamps", false, "Record when each hop's request started")
+	flag.StringVar(&flagTLSCiphers, "tls-ciphers", "", "Comma-separated TLS 1.0-1.2 cipher suites to offer")
+	flag.StringVar(&flagTLSMin, "tls-min", "", "Oldest TLS version to offer: 1.0, 1.1, 1.2 or 1.3")
+	flag.BoolVar(&flagTraceToStderr, "trace-to-stderr", false, "Print the trace to stderr, and only the clean URL to stdout")
+	flag.BoolVar(&flagTrimSlash, "trim-slash", false, "Drop a trailing slash from the clean URL's path")
+	flag.BoolVar(&flagTSV, "tsv", false, "Output one tab-separated row per hop: number, status, class, url")
+	flag.BoolVar(&flagTSVHeader, "tsv-header", false, "Like -tsv, with a header row first")
+	flag.StringVar(&flagUser, "u", "", "Login (user:password) for the starting URL's host")
+	flag.StringVar(&flagUA, "ua", "", "Send this User-Agent instead of the default browser one")
+	flag.DurationVar(&flagURLDeadline, "url-deadline", 0, "Maximum time to spend tracing each URL (e.g. 3s)")
 	flag.BoolVar(&flagVerbose, "v", false, "Show verbose trace results")
+	flag.IntVar(&flagWarnHops, "warn-hops", 0, "Warn when a chain has more than this many hops")
 	flag.IntVar(&flagWidth, "w", 120, "Width of the URL tab")
 
 	// Load configuration from file, if exists
@@ -568,25 +4972,37 @@ func main() {
 		flagOutputJSON = config.UseJSON
 		flagTerse = config.AlwaysTerse
 		flagVerbose = config.AlwaysVerbose
-		flagWidth = config.Width
+		if config.Width != 0 {
+			flagWidth = config.Width
+		}
+
+		for host, name := range config.Shorteners {
+			knownShorteners[strings.TrimPrefix(strings.ToLower(host), "www.")] = name
+		}
+		for _, name := range config.SensitiveParams {
+			sensitiveParams[strings.ToLower(name)] = true
+		}
 	}
 
-	flag.Parse()
+	// An optional subcommand comes before any flags; a bare URL (or -f) still works as it always has
+	command, cmdArgs := splitCommand(os.Args[1:])
+	if command == "version" {
+		fmt.Printf("go-trace %s\n", buildVersion())
+		os.Exit(0)
+	}
+	flag.CommandLine.Parse(cmdArgs)
 	args := flag.Args()
 
-	// Check if there are additional arguments after the URL
-	if len(args) < 1 {
-		printUsageMessage()
-		os.Exit(1)
+	// A profile from the config file fills in the flags that weren't given
+	if flagProfile != "" {
+		if err := applyProfile(config, flagProfile); err != nil {
+			fmt.Printf("Error with -profile: %s\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// Get the URL from the command-line arguments
-	url := args[0]
-
-	// Check if there are flags after the URL
-	if len(args) > 1 {
-		printUsageMessage()
-		os.Exit(1)
+	if flagNoColor || os.Getenv("NO_COLOR") != "" {
+		disableColors()
 	}
 
 	// If help requested, print message and exit
@@ -595,17 +5011,130 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Perform the trace
-	redirectURL, hops, cloudflareStatus, err := followRedirects(url)
+	// Expect exactly one URL, or none when reading from a file
+	if flagFile != "" && flagFileJSON != "" {
+		fmt.Println("Use either -f or -fj, not both.")
+		os.Exit(1)
+	}
+	batch := flagFile != "" || flagFileJSON != ""
+	if command == "batch" && !batch {
+		fmt.Println("go-trace batch needs -f or -fj.")
+		os.Exit(1)
+	}
+	if command == "trace" && batch {
+		fmt.Println("go-trace trace takes a URL, not -f or -fj (use go-trace batch).")
+		os.Exit(1)
+	}
+	if !slices.Contains(batchSorts, flagSort) {
+		fmt.Printf("Unknown -sort %q (expected one of: %s)\n", flagSort, strings.Join(batchSorts, ", "))
+		os.Exit(1)
+	}
+	if (!batch && len(args) != 1) || (batch && len(args) != 0) {
+		printUsageMessage()
+		os.Exit(1)
+	}
+
+	// With -base, the URLs given can be paths on one site
+	var base *url.URL
+	if flagBase != "" {
+		var err error
+		base, err = url.Parse(flagBase)
+		if err != nil || !isHTTPScheme(base.Scheme) || base.Host == "" {
+			fmt.Printf("-base needs a full http(s) URL, like https://example.com/, not %q\n", flagBase)
+			os.Exit(1)
+		}
+	}
+
+	// JSON in, JSON out: -fj results come back as an array in the same order
+	if flagFileJSON != "" {
+		flagOutputJSON = true
+	}
+
+	// Rebuild the client if any transport settings were given
+	proxies := make(map[string]string)
+	if config != nil {
+		maps.Copy(proxies, config.Proxies)
+	}
+	if flagProxy != "" {
+		proxies["default"] = flagProxy
+	}
+
+	poolTuned := config != nil && (config.MaxIdleConns != 0 || config.MaxIdleConnsPerHost != 0 || config.IdleConnTimeout != "")
+	clientOpts := ClientOptions{HTTP3: flagHTTP3, NoKeepAlive: flagNoKeepAlive}
+
+	if poolTuned {
+		clientOpts.MaxIdleConns = config.MaxIdleConns
+		clientOpts.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+		if config.IdleConnTimeout != "" {
+			clientOpts.IdleConnTimeout, err = time.ParseDuration(config.IdleConnTimeout)
+			if err != nil {
+				fmt.Printf("Error in config: idle_conn_timeout: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	clientOpts.Resolve, err = parseResolve(flagResolve)
 	if err != nil {
-		fmt.Printf("Error tracing URL: %s\n", err)
+		fmt.Printf("Error parsing -resolve: %s\n", err)
 		os.Exit(1)
 	}
+	if flagCACert != "" {
+		clientOpts.RootCAs, err = loadCACerts(flagCACert)
+		if err != nil {
+			fmt.Printf("Error loading -cacert: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if flagCert != "" {
+		// Like curl, the key can be in the certificate's file
+		cert, err := tls.LoadX509KeyPair(flagCert, cmp.Or(flagKey, flagCert))
+		if err != nil {
+			fmt.Printf("Error loading -cert/-key: %s\n", err)
+			os.Exit(1)
+		}
+		clientOpts.Certificates = []tls.Certificate{cert}
+	}
+	clientOpts.Proxies, err = parseProxies(proxies)
+	if err != nil {
+		fmt.Printf("Error with proxies: %s\n", err)
+		os.Exit(1)
+	}
+	if flagInterface != "" {
+		clientOpts.LocalAddr, err = parseLocalAddr(flagInterface)
+		if err != nil {
+			fmt.Printf("Error with -interface: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if flagTLSMin != "" {
+		clientOpts.TLSMinVersion, err = parseTLSVersion(flagTLSMin)
+		if err != nil {
+			fmt.Printf("Error parsing -tls-min: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if flagTLSCiphers != "" {
+		clientOpts.TLSCiphers, err = parseTLSCiphers(flagTLSCiphers)
+		if err != nil {
+			fmt.Printf("Error parsing -tls-ciphers: %s\n", err)
+			os.Exit(1)
+		}
+	}
 
-	traceResult := TraceResult{
-		Hops:     hops,
-		FinalURL: redirectURL,
-		CleanURL: makeCleanURL(redirectURL),
+	client = createHTTPClient(clientOpts)
+	showTLS = flagTLSMin != "" || flagTLSCiphers != ""
+
+	// An explicit width (flag or config) wins; otherwise fit the terminal, if there is one
+	widthSet := config != nil && config.Width != 0
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "w" {
+			widthSet = true
+		}
+	})
+	if !widthSet {
+		if width, ok := terminalURLWidth(); ok {
+			flagWidth = width
+		}
 	}
 
 	// Change URL tab width, if required.
@@ -614,20 +5143,389 @@ func main() {
 		outputDividerWidth = flagWidth + 15
 	}
 
+	warnHops = flagWarnHops
+	quiet = flagQuiet
+	canonicalize = flagCanonical
+	trimSlash = flagTrimSlash
+	showBytes = flagBytes
+	normalizeEncoding = flagNormalizeEncoding
+	sortQuery = flagSortQuery
+	sanitize = flagSanitize
+	interestingOnly = flagInteresting
+
+	// -compact is just a denser -j
+	if flagCompact {
+		compactJSON = true
+		flagOutputJSON = true
+	}
+
+	viewOption := "short"
+	if flagTemplate != "" {
+		// The template decides the whole output, so it beats -j and the other views
+		tmpl, err := template.New("output").Funcs(templateFuncs).Parse(flagTemplate)
+		if err != nil {
+			fmt.Printf("Error parsing -template: %s\n", err)
+			os.Exit(1)
+		}
+		outputTemplate = tmpl
+		viewOption = "template"
+		flagOutputJSON = false
+	} else if flagCount {
+		// A bare number is the whole point, so this beats -j as well
+		viewOption = "count"
+		flagOutputJSON = false
+	} else if flagHostCount {
+		// Likewise a bare number
+		viewOption = "hostcount"
+		flagOutputJSON = false
+	} else if flagListHops {
+		// Bare URLs for piping, whatever else was asked for
+		viewOption = "list"
+		flagOutputJSON = false
+	} else if flagArrow || flagArrowHosts {
+		// One line per chain, for logs
+		viewOption = "arrow"
+		arrowHosts = flagArrowHosts
+		flagOutputJSON = false
+	} else if flagTSV || flagTSVHeader {
+		// Columns for awk -F'\t', with nothing else mixed in
+		viewOption = "tsv"
+		tsvSource = batch
+		flagOutputJSON = false
+	} else if flagHop != 0 {
+		// One URL for scripts, like -list-hops
+		viewOption = "hop"
+		selectedHop = flagHop
+		hopWithStatus = flagVerbose
+		flagOutputJSON = false
+	} else if flagDOT {
+		viewOption = "dot"
+		flagOutputJSON = false
+	} else if flagTerse {
+		viewOption = "terse"
+	} else if flagVerbose {
+		viewOption = "verbose"
+	}
+
+	// With -trace-to-stderr, everything meant for a person goes to stderr; the real stdout only gets the URL
+	var traceOut io.Writer = os.Stdout
+	if flagTraceToStderr {
+		if !decoratedView(viewOption) || flagOutputJSON {
+			fmt.Println("-trace-to-stderr works with the default and -v output, not -s, -j or the other views.")
+			os.Exit(1)
+		}
+		urlOut = os.Stdout
+		traceOut = os.Stderr
+	}
+
+	opts := TraceOptions{
+		NoDowngrade:        flagNoDowngrade,
+		AllowDowngradeOnce: flagAllowDowngradeOnce,
+		NoUnwrap:           flagNoUnwrap,
+		Method:             flagMethod,
+		Data:               flagData,
+		ContentType:        flagContentType,
+		Timestamps:         flagTimestamps,
+		URLDeadline:        flagURLDeadline,
+		HopTimeout:         flagHopTimeout,
+		HeadThenGet:        flagHeadThenGet,
+		MaxHops:            flagMaxHops,
+		SaveBody:           flagSaveBody,
+		SameOrigin:         flagSameOrigin,
+		StopOnTracking:     flagStopOnTracking,
+		RequireHTTPS:       flagRequireHTTPS,
+		Peek:               flagPeek,
+		NoBody:             flagNoBody,
+		Meta:               flagMeta,
+		UserAgent:          flagUA,
+		MaxBody:            flagMaxBody,
+		MaxPerHost:         flagMaxPerHost,
+		MaxHostChanges:     flagMaxHostChanges,
+		MaxTotalBytes:      flagMaxTotalBytes,
+		FailOnError:        flagFailOnError,
+		Capture:            flagHAR != "" || flagOTel,
+	}
+	if flagNoBody && flagMeta {
+		fmt.Fprintln(os.Stderr, "Warning: -meta needs to read page bodies, so -no-body is ignored.")
+		opts.NoBody = false
+	} else if flagNoBody && flagSaveBody != "" {
+		fmt.Fprintln(os.Stderr, "Warning: -save-body needs the landing page's body, so -no-body only applies to the redirects.")
+	}
+
+	if len(flagHeaders) > 0 || flagLang != "" || flagBrowser {
+		headers, err := parseHeaders(flagHeaders)
+		if err != nil {
+			fmt.Printf("Error parsing -H: %s\n", err)
+			os.Exit(1)
+		}
+		// An explicit -H Accept-Language wins over -lang
+		if flagLang != "" && headers.Get("Accept-Language") == "" {
+			headers.Set("Accept-Language", flagLang)
+		}
+		// The -browser preset fills in whatever -H, -lang and -ua haven't already set
+		if flagBrowser {
+			for name, values := range browserHeaders {
+				if headers.Get(name) != "" || (name == "User-Agent" && flagUA != "") {
+					continue
+				}
+				headers[name] = values
+			}
+		}
+		opts.Headers = headers
+	}
+
+	if flagFollowCodes != "" {
+		codes, err := parseFollowCodes(flagFollowCodes)
+		if err != nil {
+			fmt.Printf("Error parsing -follow-codes: %s\n", err)
+			os.Exit(1)
+		}
+		opts.FollowCodes = codes
+	}
+
+	if flagLogJSON {
+		opts.Logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+	}
+
+	opts.ExpectFinal = flagExpectFinal
+	if flagB64Params != "" {
+		opts.B64Params = strings.Split(flagB64Params, ",")
+	}
+	if config != nil {
+		opts.B64Params = append(opts.B64Params, config.B64Params...)
+	}
+	if flagExpectType != "" {
+		opts.ExpectTypes = strings.Split(flagExpectType, ",")
+	}
+
+	if flagNetrc {
+		creds, err := loadNetrc()
+		if err != nil {
+			fmt.Printf("Error reading netrc: %s\n", err)
+			os.Exit(1)
+		}
+		opts.Credentials = creds
+	}
+
+	var userCred *Credential
+	if flagUser != "" {
+		cred, err := parseUserFlag(flagUser)
+		if err != nil {
+			fmt.Printf("Error reading -u: %s\n", err)
+			os.Exit(1)
+		}
+		userCred = &cred
+	}
+
+	// Recording wraps the real transport; replaying replaces it, so nothing goes out over the network
+	switch {
+	case flagRecord != "" && flagReplay != "":
+		fmt.Println("-record and -replay can't be used together.")
+		os.Exit(1)
+	case flagRecord != "":
+		if err := os.MkdirAll(flagRecord, 0o755); err != nil {
+			fmt.Printf("Error creating -record directory: %s\n", err)
+			os.Exit(1)
+		}
+		// Bodies are saved only as far as the trace itself would read them
+		bodyLimit := int64(fixtureBodyLimit)
+		for _, limit := range []int64{opts.MaxBody, opts.MaxTotalBytes} {
+			if limit > 0 {
+				bodyLimit = min(bodyLimit, limit)
+			}
+		}
+		if opts.NoBody {
+			bodyLimit = 0
+		}
+		opts.Transport = &fixtureRecorder{dir: flagRecord, next: client.Transport, bodyLimit: bodyLimit, seen: make(map[string]int)}
+	case flagReplay != "":
+		if info, err := os.Stat(flagReplay); err != nil || !info.IsDir() {
+			fmt.Printf("Error: -replay needs the directory -record saved to (%s isn't one)\n", flagReplay)
+			os.Exit(1)
+		}
+		opts.Transport = &fixtureReplayer{dir: flagReplay, seen: make(map[string]int)}
+	}
+
+	var jar *cookieJar
+	if flagCookieJar != "" {
+		var err error
+		jar, err = loadCookieJar(flagCookieJar)
+		if err != nil {
+			fmt.Printf("Error reading cookie jar: %s\n", err)
+			os.Exit(1)
+		}
+		client.Jar = jar
+	}
+
+	// Ctrl-C or SIGTERM cancels the trace; completed results are still printed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Stepping through hops needs someone at the keyboard, and a single trace printed as text
+	if flagInteractive && isTerminal(os.Stdin) && !batch && !flagOutputJSON {
+		opts.OnHop = stepThroughHops(ctx, traceOut)
+	} else if flagStream {
+		// Batch traces run side by side, so their hops can't be streamed into one table
+		if batch || !decoratedView(viewOption) || flagOutputJSON {
+			fmt.Println("-stream works with a single URL and the default or -v output, not -f, -s, -j or the other views.")
+			os.Exit(1)
+		}
+		ClearTerminal(traceOut)
+		opts.OnHop = streamHops(traceOut)
+	}
+
+	if batch {
+		if flagGroupByFinal && !flagOutputJSON && !decoratedView(viewOption) {
+			fmt.Println("-group-by-final works with the default, -v and -j output, not -s or the other views.")
+			os.Exit(1)
+		}
+		if flagSaveBody != "" || flagCompareUA != "" {
+			fmt.Println("-save-body and -compare-ua only work with a single URL, not -f or -fj.")
+			os.Exit(1)
+		}
+
+		var urls []string
+		var err error
+		if flagFileJSON != "" {
+			urls, err = readURLJSON(flagFileJSON)
+		} else {
+			urls, err = readURLList(flagFile)
+		}
+		if err == nil {
+			urls, err = resolveAgainst(base, urls)
+		}
+		if err != nil {
+			fmt.Printf("Error reading URL list: %s\n", err)
+			os.Exit(1)
+		}
+		if userCred != nil {
+			opts.Credentials = withStartingHosts(opts.Credentials, *userCred, urls...)
+		}
+		opts.Headers, opts.HostHeaders = splitHostHeaders(opts.Headers, urls...)
+		if flagTSVHeader {
+			fmt.Println(tsvHeader())
+		}
+		exitCode := runBatch(ctx, urls, opts, BatchOptions{
+			OutputJSON:   flagOutputJSON,
+			ViewOption:   viewOption,
+			SortBy:       flagSort,
+			GroupByFinal: flagGroupByFinal,
+			NoCache:      flagNoCache,
+			HARPath:      flagHAR,
+			OTel:         flagOTel,
+			Syslog:       flagSyslog,
+			Out:          traceOut,
+		})
+		saveCookieJar(jar, flagCookieJar)
+		stop()
+		os.Exit(exitCode)
+	}
+
+	// Perform the trace
+	resolved, err := resolveAgainst(base, args[:1])
+	if err != nil {
+		fmt.Printf("Error with the URL: %s\n", err)
+		os.Exit(1)
+	}
+	url := resolved[0]
+	if userCred != nil {
+		opts.Credentials = withStartingHosts(opts.Credentials, *userCred, url)
+	}
+	opts.Headers, opts.HostHeaders = splitHostHeaders(opts.Headers, url)
+
+	if flagCompareUA != "" {
+		exitCode := compareUserAgents(ctx, traceOut, url, opts, flagCompareUA, flagOutputJSON, viewOption)
+		saveCookieJar(jar, flagCookieJar)
+		stop()
+		os.Exit(exitCode)
+	}
+	redirectURL, hops, err := followRedirects(ctx, url, opts)
+	logTraceError(opts, url, err)
+	saveCookieJar(jar, flagCookieJar)
+	interrupted := errors.Is(err, context.Canceled)
+	// A bad final status (or a spent byte budget) still has a chain to show, so it's reported after the usual output
+	badStatus := keepsResult(err)
+	if err != nil && !interrupted && !badStatus {
+		handleTraceError(traceOut, err)
+	}
+
+	traceResult := newTraceResult(url, redirectURL, hops)
+	if interrupted {
+		traceResult.Error = "interrupted"
+	} else if badStatus {
+		traceResult.Error = redactText(err.Error())
+	}
+
+	if flagOTel {
+		if err := exportOTLP([]TraceResult{traceResult}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending spans to the OpenTelemetry collector: %s\n", err)
+		}
+	}
+	if flagSyslog != "" {
+		if err := sendSyslog(flagSyslog, []TraceResult{traceResult}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending the result to syslog at %s: %s\n", flagSyslog, err)
+		}
+	}
+
+	if flagHAR != "" {
+		if err := writeHAR(flagHAR, []TraceResult{traceResult}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing HAR: %s\n", err)
+			os.Exit(1)
+		}
+		// With the HAR on stdout, it stands in for the usual output
+		if flagHAR == "-" {
+			switch {
+			case interrupted:
+				os.Exit(130)
+			case badStatus:
+				fmt.Fprintf(os.Stderr, "Error: %s\n", traceResult.Error)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	// Save to JSON if requested
 	if flagOutputJSON {
 		outputAsJSON(traceResult)
+		printWarnings(traceResult)
+		if interrupted {
+			os.Exit(130)
+		}
+		if badStatus {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
-	// Print the trace result in terse or tabular format
-	if flagTerse {
-		printTraceResult(redirectURL, nil, cloudflareStatus, "terse")
-	} else if flagVerbose {
-		ClearTerminal()
-		printTraceResult(redirectURL, hops, cloudflareStatus, "verbose")
-	} else {
-		ClearTerminal()
-		printTraceResult(redirectURL, nil, cloudflareStatus, "short")
+	if interrupted {
+		if len(hops) == 0 {
+			fmt.Fprintln(traceOut, "\nTrace interrupted before any hops completed.")
+		} else {
+			fmt.Fprintln(traceOut, "\nTrace interrupted. Hops completed so far:")
+			printTraceResult(traceOut, newTraceResult(url, hops[len(hops)-1].URL, hops), "verbose")
+		}
+		os.Exit(130)
+	}
+
+	// Print the trace result in terse or tabular format, keeping an interactive walkthrough on screen
+	if decoratedView(viewOption) && opts.OnHop == nil {
+		ClearTerminal(traceOut)
+	}
+	if flagTSVHeader {
+		fmt.Println(tsvHeader())
+	}
+	printErr := printTraceResult(traceOut, traceResult, viewOption)
+	printWarnings(traceResult)
+
+	if _, ok := nthHop(hops, selectedHop); viewOption == "hop" && !ok {
+		os.Exit(1)
+	}
+	if badStatus {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n", traceResult.Error)
+		os.Exit(1)
+	}
+	if printErr != nil {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,953 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateHTTPClientHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client := createHTTPClient(ClientOptions{RootCAs: roots})
+
+	_, hops, err := followRedirects(context.Background(), server.URL, TraceOptions{Client: client})
+	if err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	if hops[0].Proto != "HTTP/2.0" {
+		t.Errorf("Proto = %q, want HTTP/2.0 from a server that offers it", hops[0].Proto)
+	}
+}
+
+func TestParseResolve(t *testing.T) {
+	tests := []struct {
+		entry   string
+		key, ip string
+	}{
+		{"example.com:127.0.0.1", "example.com", "127.0.0.1"},
+		{"example.com:443:127.0.0.1", "example.com:443", "127.0.0.1"},
+		{"example.com:::1", "example.com", "::1"},
+		{"example.com:443:[::1]", "example.com:443", "::1"},
+	}
+	for _, tt := range tests {
+		resolve, err := parseResolve([]string{tt.entry})
+		if err != nil {
+			t.Errorf("parseResolve(%q): %v", tt.entry, err)
+			continue
+		}
+		if resolve[tt.key] != tt.ip {
+			t.Errorf("parseResolve(%q) = %v, want %s -> %s", tt.entry, resolve, tt.key, tt.ip)
+		}
+	}
+
+	for _, entry := range []string{"example.com", ":127.0.0.1", "example.com:443:nowhere"} {
+		if _, err := parseResolve([]string{entry}); err == nil {
+			t.Errorf("parseResolve(%q) succeeded, want an error", entry)
+		}
+	}
+
+	// The curl form pins just its port
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+	resolve, _ := parseResolve([]string{"pinned.test:" + port + ":127.0.0.1"})
+	client := createHTTPClient(ClientOptions{Resolve: resolve})
+	if _, _, err := followRedirects(context.Background(), "http://pinned.test:"+port+"/", TraceOptions{Client: client}); err != nil {
+		t.Errorf("tracing the pinned host and port: %v", err)
+	}
+}
+
+func TestFollowRedirectsNoDowngrade(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL, http.StatusFound)
+	}))
+	defer secure.Close()
+
+	_, hops, err := followRedirects(context.Background(), secure.URL, TraceOptions{Client: secure.Client(), NoDowngrade: true})
+	if !errors.Is(err, ErrDowngrade) || !keepsResult(err) {
+		t.Fatalf("err = %v, want ErrDowngrade, with its result kept", err)
+	}
+	if len(hops) != 1 || !hops[0].Downgrade {
+		t.Errorf("got %d hops, want the one downgrading hop marked Downgrade", len(hops))
+	}
+}
+
+func TestURLDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/silent", http.StatusFound)
+		case "/silent":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	_, hops, err := followRedirects(context.Background(), server.URL+"/start", TraceOptions{URLDeadline: 50 * time.Millisecond})
+	if !errors.Is(err, ErrURLDeadline) || !keepsResult(err) {
+		t.Fatalf("err = %v, want ErrURLDeadline, keeping the result", err)
+	}
+	if len(hops) != 2 || hops[1].StatusCode != 0 || !strings.Contains(hops[1].Note, "time budget") {
+		t.Errorf("got %d hops, want the redirect and the URL left unfetched", len(hops))
+	}
+}
+
+// newRedirectServer serves a small redirect chain for each status code under test:
+// /code/<code> redirects (absolutely or relatively) to /done, which answers 200, and /data and /javascript
+// redirect to URIs that can't be fetched
+func newRedirectServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	})
+	for _, code := range []int{301, 302, 303, 307, 308} {
+		mux.HandleFunc(statusPath(code), func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Location", "http://"+r.Host+"/done")
+			w.WriteHeader(code)
+		})
+	}
+	mux.HandleFunc("/relative", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/done")
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/loop")
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("/no-location", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "data:text/html,<h1>Hello</h1>")
+		w.WriteHeader(http.StatusFound)
+	})
+	mux.HandleFunc("/javascript", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "javascript:alert(document.cookie)")
+		w.WriteHeader(http.StatusFound)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// statusPath is the path newRedirectServer redirects from with code
+func statusPath(code int) string {
+	return "/code/" + strconv.Itoa(code)
+}
+
+func TestFollowRedirects(t *testing.T) {
+	server := newRedirectServer(t)
+
+	tests := []struct {
+		name      string
+		path      string
+		wantCodes []int
+		wantFinal string // a path on the server, or a URI of its own
+		wantNote  string // in the last hop's note
+	}{
+		{"301", statusPath(301), []int{301, 200}, "/done", ""},
+		{"302", statusPath(302), []int{302, 200}, "/done", ""},
+		{"303", statusPath(303), []int{303, 200}, "/done", ""},
+		{"307", statusPath(307), []int{307, 200}, "/done", ""},
+		{"308", statusPath(308), []int{308, 200}, "/done", ""},
+		{"relative Location", "/relative", []int{302, 200}, "/done", ""},
+		{"terminal 200", "/done", []int{200}, "/done", ""},
+		{"loop", "/loop", []int{302, http.StatusLoopDetected}, "/loop", ""},
+		{"data: target", "/data", []int{302, 0}, "data:text/html,<h1>Hello</h1>", "data: scheme, text/html"},
+		{"javascript: target", "/javascript", []int{302, 0}, "javascript:alert(document.cookie)", "javascript: scheme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every request goes through here, so anything not http(s) would show up
+			var schemes []string
+			transport := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				schemes = append(schemes, req.URL.Scheme)
+				return http.DefaultTransport.RoundTrip(req)
+			})
+
+			finalURL, hops, err := followRedirects(context.Background(), server.URL+tt.path, TraceOptions{Transport: transport})
+			if err != nil {
+				t.Fatalf("followRedirects: %v", err)
+			}
+			wantFinal := tt.wantFinal
+			if uriScheme(wantFinal) == "" {
+				wantFinal = server.URL + wantFinal
+			}
+			if finalURL != wantFinal {
+				t.Errorf("final URL = %q, want %q", finalURL, wantFinal)
+			}
+			if slices.ContainsFunc(schemes, func(scheme string) bool { return scheme != "http" }) {
+				t.Errorf("requests were made with schemes %v, want only http", schemes)
+			}
+			if note := hops[len(hops)-1].Note; !strings.Contains(note, tt.wantNote) {
+				t.Errorf("last hop's note = %q, want it to mention %q", note, tt.wantNote)
+			}
+
+			var codes []int
+			for _, hop := range hops {
+				codes = append(codes, hop.StatusCode)
+			}
+			if !slices.Equal(codes, tt.wantCodes) {
+				t.Errorf("status codes = %v, want %v", codes, tt.wantCodes)
+			}
+
+			result := newTraceResult(server.URL+tt.path, finalURL, hops)
+			if last := result.Hops[len(result.Hops)-1]; !last.IsFinal || last.IsRedirect {
+				t.Errorf("last hop IsFinal = %v, IsRedirect = %v, want true, false", last.IsFinal, last.IsRedirect)
+			}
+		})
+	}
+}
+
+// roundTripFunc lets a function stand in for an http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestFollowRedirectsNoLocation(t *testing.T) {
+	server := newRedirectServer(t)
+
+	finalURL, hops, err := followRedirects(context.Background(), server.URL+"/no-location", TraceOptions{})
+	if err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	if finalURL != "" || len(hops) != 0 {
+		t.Errorf("got %q with %d hops, want no final URL and no hops", finalURL, len(hops))
+	}
+}
+
+// newChainServer serves /hop/n, which redirects to /hop/n-1 down to /hop/0, which answers 200
+func newChainServer(tb testing.TB) *httptest.Server {
+	tb.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if n <= 0 {
+			w.Write([]byte("done"))
+			return
+		}
+		http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1)+"?"+r.URL.RawQuery, http.StatusFound)
+	}))
+	tb.Cleanup(server.Close)
+	return server
+}
+
+func BenchmarkFollowRedirects(b *testing.B) {
+	server := newChainServer(b)
+
+	for _, n := range []int{1, 10, 50} {
+		b.Run(strconv.Itoa(n)+"-hops", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := followRedirects(context.Background(), server.URL+"/hop/"+strconv.Itoa(n), TraceOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRunBatch(b *testing.B) {
+	server := newChainServer(b)
+
+	// runBatch prints its results; they aren't what's being measured
+	stdout := os.Stdout
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		b.Fatal(err)
+	}
+	os.Stdout = devNull
+	b.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+
+	for _, m := range []int{10, 100} {
+		// Distinct URLs, so the batch's cache of repeats doesn't skip any
+		urls := make([]string, m)
+		for i := range urls {
+			urls[i] = server.URL + "/hop/3?u=" + strconv.Itoa(i)
+		}
+
+		b.Run(strconv.Itoa(m)+"-urls", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				runBatch(context.Background(), urls, TraceOptions{}, BatchOptions{OutputJSON: true, SortBy: "input"})
+			}
+		})
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	results := []TraceResult{{Hops: []Hop{
+		{Number: 1, URL: `https://example.com/a"b\c`, StatusCode: 301},
+		{Number: 2, URL: "https://例え.jp/ページ", StatusCode: 200},
+	}}}
+
+	var out strings.Builder
+	writeDOT(&out, results)
+	want := `"https://example.com/a\"b\\c" -> "https://例え.jp/ページ" [label="301"];`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("writeDOT output:\n%s\nwant it to contain %s", out.String(), want)
+	}
+}
+
+func TestHTTP3FallsBackToTCP(t *testing.T) {
+	// A TLS server with no QUIC listener on its port
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client := createHTTPClient(ClientOptions{HTTP3: true, RootCAs: roots})
+
+	_, hops, err := followRedirects(context.Background(), server.URL, TraceOptions{Client: client})
+	if err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	if hops[0].Proto != "HTTP/2.0" {
+		t.Errorf("Proto = %q, want HTTP/2.0 over TCP once QUIC fails", hops[0].Proto)
+	}
+}
+
+func TestMaxHops(t *testing.T) {
+	// Every hop is a new URL, so only the cap stops it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		http.Redirect(w, r, "/"+strconv.Itoa(n+1), http.StatusFound)
+	}))
+	defer server.Close()
+
+	_, hops, err := followRedirects(context.Background(), server.URL+"/0", TraceOptions{MaxHops: 20})
+	if !errors.Is(err, ErrTooManyRedirects) || !keepsResult(err) {
+		t.Fatalf("err = %v, want ErrTooManyRedirects, keeping the result", err)
+	}
+	if len(hops) != 20 {
+		t.Errorf("got %d hops, want the 20 before the cap", len(hops))
+	}
+}
+
+func TestRedactText(t *testing.T) {
+	sanitize = true
+	defer func() { sanitize = false }()
+
+	got := redactText(`error accessing URL: Get "https://user:pw@example.com/cb?token=abc&page=2": dial tcp: no such host`)
+	want := `error accessing URL: Get "https://***@example.com/cb?token=***&page=2": dial tcp: no such host`
+	if got != want {
+		t.Errorf("redactText = %q, want %q", got, want)
+	}
+}
+
+func TestStartingHostHeaders(t *testing.T) {
+	var got http.Header
+	var gotHost string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, gotHost = r.Header.Clone(), r.Host
+	}))
+	defer other.Close()
+	var startAuth string
+	start := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startAuth = r.Header.Get("Authorization")
+		// The same server, under another name
+		http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer start.Close()
+
+	headers, err := parseHeaders([]string{"Authorization: Bearer secret", "Cookie: session=abc", "X-Trace: 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := TraceOptions{}
+	opts.Headers, opts.HostHeaders = splitHostHeaders(headers, start.URL)
+
+	if _, _, err := followRedirects(context.Background(), start.URL, opts); err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	if startAuth != "Bearer secret" {
+		t.Errorf("starting host got Authorization %q, want it sent", startAuth)
+	}
+	if got.Get("Authorization") != "" || got.Get("Cookie") != "" {
+		t.Errorf("other host got Authorization %q and Cookie %q, want neither", got.Get("Authorization"), got.Get("Cookie"))
+	}
+	if got.Get("X-Trace") != "1" {
+		t.Errorf("other host got X-Trace %q, want it on every hop", got.Get("X-Trace"))
+	}
+	if !strings.HasPrefix(gotHost, "localhost") {
+		t.Errorf("other host was asked for Host %q", gotHost)
+	}
+}
+
+func TestCompareUserAgentsOneSideFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() == "bot" {
+			// Hang up without a response
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// A side that fails is reported in the comparison, not fatal
+	if code := compareUserAgents(context.Background(), io.Discard, server.URL, TraceOptions{}, "bot", false, "terse"); code != 1 {
+		t.Errorf("exit code = %d, want 1 for a comparison where one trace failed", code)
+	}
+}
+
+// captureStdout returns what fn writes to stdout, where the JSON output goes
+func captureStdout(t *testing.T, fn func()) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- out
+	}()
+
+	fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-done
+}
+
+func TestCompareUserAgentsJSON(t *testing.T) {
+	server := newChainServer(t)
+
+	out := captureStdout(t, func() {
+		compareUserAgents(context.Background(), io.Discard, server.URL+"/hop/1", TraceOptions{}, "bot", true, "short")
+	})
+	var comparison UAComparison
+	if err := json.Unmarshal(out, &comparison); err != nil {
+		t.Fatalf("output isn't a comparison: %v\n%s", err, out)
+	}
+	if comparison.SchemaVersion != schemaVersion || len(comparison.Traces) != 2 || comparison.Traces[1].UserAgent != "bot" {
+		t.Errorf("got %+v, want the schema version and a trace per User-Agent", comparison)
+	}
+}
+
+func TestHARMasksSecrets(t *testing.T) {
+	hop := Hop{
+		Number:         1,
+		URL:            "https://example.com/cb?token=abc",
+		StatusCode:     302,
+		started:        time.Now(),
+		requestHeader:  http.Header{"Authorization": {"Bearer secret"}, "Accept": {"*/*"}},
+		responseHeader: http.Header{"Set-Cookie": {"session=secret"}, "Location": {"https://example.com/next?token=abc"}},
+	}
+	results := []TraceResult{{OriginalURL: hop.URL, Hops: []Hop{hop}}}
+
+	entry := newHAR(results).Log.Entries[0]
+	for _, nv := range append(entry.Request.Headers, entry.Response.Headers...) {
+		if strings.Contains(nv.Value, "secret") {
+			t.Errorf("header %s = %q, want it masked", nv.Name, nv.Value)
+		}
+	}
+	if entry.Request.URL != hop.URL {
+		t.Errorf("URL = %q without -sanitize, want %q", entry.Request.URL, hop.URL)
+	}
+
+	sanitize = true
+	defer func() { sanitize = false }()
+	entry = newHAR(results).Log.Entries[0]
+	if strings.Contains(entry.Request.URL, "abc") || strings.Contains(entry.Response.RedirectURL, "abc") {
+		t.Errorf("URL = %q, RedirectURL = %q under -sanitize, want the token masked", entry.Request.URL, entry.Response.RedirectURL)
+	}
+	for _, nv := range entry.Request.QueryString {
+		if nv.Value == "abc" {
+			t.Errorf("query %s = %q under -sanitize, want it masked", nv.Name, nv.Value)
+		}
+	}
+}
+
+func TestFollowRedirectsMultipleLocations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			w.Write([]byte(r.URL.Path))
+			return
+		}
+		w.Header().Add("Location", "/first")
+		w.Header().Add("Location", "/second")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer server.Close()
+
+	finalURL, hops, err := followRedirects(context.Background(), server.URL+"/", TraceOptions{})
+	if err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	if want := server.URL + "/first"; finalURL != want {
+		t.Errorf("final URL = %q, want %q", finalURL, want)
+	}
+	if len(hops) != 2 {
+		t.Fatalf("got %d hops, want 2", len(hops))
+	}
+	if want := "2 Location headers, following the first"; hops[0].Note != want {
+		t.Errorf("note = %q, want %q", hops[0].Note, want)
+	}
+}
+
+func TestFollowRedirectsWebSocketUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	}))
+	defer server.Close()
+
+	finalURL, hops, err := followRedirects(context.Background(), server.URL+"/ws", TraceOptions{})
+	if err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	if finalURL != server.URL+"/ws" {
+		t.Errorf("final URL = %q, want %q", finalURL, server.URL+"/ws")
+	}
+	if len(hops) != 1 {
+		t.Fatalf("got %d hops, want 1", len(hops))
+	}
+	if hop := hops[0]; hop.StatusCode != http.StatusSwitchingProtocols || hop.Note != "WebSocket upgrade" || !hop.IsFinal {
+		t.Errorf("hop = %d %q (IsFinal %v), want a final 101 noted \"WebSocket upgrade\"", hop.StatusCode, hop.Note, hop.IsFinal)
+	}
+}
+
+func TestReturnsToStart(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string // appended to the server's URL to start from
+		comesBack bool   // whether / serves a page the second time, rather than redirecting again
+		want      bool
+	}{
+		// With its query in another order, the start counts as a different URL from where it lands, so it isn't a loop
+		{"lands back at the start", "/?b=2&a=1", true, true},
+		{"loops back to the start", "/?a=1&b=2", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			visits := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/away" {
+					http.Redirect(w, r, "/?a=1&b=2", http.StatusFound)
+					return
+				}
+				visits++
+				if tt.comesBack && visits > 1 {
+					w.Write([]byte("ok"))
+					return
+				}
+				http.Redirect(w, r, "/away", http.StatusFound)
+			}))
+			defer server.Close()
+
+			start := server.URL + tt.path
+			finalURL, hops, err := followRedirects(context.Background(), start, TraceOptions{})
+			if err != nil {
+				t.Fatalf("followRedirects: %v", err)
+			}
+			if result := newTraceResult(start, finalURL, hops); result.ReturnsToStart != tt.want {
+				t.Errorf("ReturnsToStart = %v, want %v (hops %+v)", result.ReturnsToStart, tt.want, hops)
+			}
+		})
+	}
+}
+
+func TestFollowRedirectsUnfollowableCodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.Header().Set("Location", "http://proxy.example/")
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		code     int
+		wantNote string
+	}{
+		{http.StatusUseProxy, "not followed (305 Use Proxy is deprecated: its Location is a proxy, not a page)"},
+		{306, "not followed (306 is an unused, reserved code)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.code), func(t *testing.T) {
+			_, hops, err := followRedirects(context.Background(), server.URL+"/"+strconv.Itoa(tt.code), TraceOptions{})
+			if err != nil {
+				t.Fatalf("followRedirects: %v", err)
+			}
+			if len(hops) != 1 {
+				t.Fatalf("got %d hops, want 1 (the Location shouldn't be followed)", len(hops))
+			}
+			if hops[0].Note != tt.wantNote {
+				t.Errorf("note = %q, want %q", hops[0].Note, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestLandingNotesAccumulate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "http://proxy.example.com:3128/")
+		w.WriteHeader(http.StatusUseProxy)
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	// What -stream and -i see has to match what -j prints
+	var streamed []Hop
+	opts := TraceOptions{SaveBody: t.TempDir() + "/body", MaxBody: 10, OnHop: func(hop Hop) { streamed = append(streamed, hop) }}
+	_, hops, err := followRedirects(context.Background(), server.URL, opts)
+	if err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	note := hops[len(hops)-1].Note
+	if !strings.Contains(note, "305 Use Proxy") || !strings.Contains(note, "body truncated to 10 bytes") {
+		t.Errorf("Note = %q, want both the 305 note and the truncation", note)
+	}
+	if len(streamed) != len(hops) || streamed[len(streamed)-1].Note != note {
+		t.Errorf("OnHop saw %+v, want the same notes as the returned hops %+v", streamed, hops)
+	}
+}
+
+func TestParseFollowCodes(t *testing.T) {
+	codes, err := parseFollowCodes("301, 302,308")
+	if err != nil || !slices.Equal(codes, []int{301, 302, 308}) {
+		t.Errorf("parseFollowCodes(\"301, 302,308\") = %v, %v", codes, err)
+	}
+
+	for _, list := range []string{"305", "302,306", "200", "abc"} {
+		if _, err := parseFollowCodes(list); err == nil {
+			t.Errorf("parseFollowCodes(%q): got no error", list)
+		}
+	}
+}
+
+func TestOTLPExportMasksURLs(t *testing.T) {
+	result := TraceResult{
+		OriginalURL: "https://user:pw@example.com/?token=abc",
+		Error:       `Get "https://example.com/?api_key=xyz": timeout`,
+		Hops:        []Hop{{Number: 1, URL: "https://example.com/?token=abc", started: time.Now()}},
+	}
+
+	export := newOTLPExport([]TraceResult{result})
+	for _, span := range export.ResourceSpans[0].ScopeSpans[0].Spans {
+		for _, attr := range span.Attributes {
+			value, _ := attr.Value["stringValue"].(string)
+			if strings.Contains(value, "abc") || strings.Contains(value, "xyz") || strings.Contains(value, "pw@") {
+				t.Errorf("span %q attribute %s = %q, want it masked", span.Name, attr.Key, value)
+			}
+		}
+	}
+}
+
+func TestByteBudgetOnRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.Header().Set("Location", "/"+strconv.Itoa(n+1))
+		w.WriteHeader(http.StatusFound)
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	_, hops, err := followRedirects(context.Background(), server.URL+"/0", TraceOptions{MaxTotalBytes: 2500, MaxHops: 20})
+	if !errors.Is(err, ErrByteBudget) {
+		t.Fatalf("err = %v, want ErrByteBudget", err)
+	}
+	if len(hops) != 3 || !strings.Contains(hops[2].Note, "budget ran out") {
+		t.Errorf("got %d hops (last note %q), want the walk stopped at the third with a note", len(hops), hops[len(hops)-1].Note)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "example.org", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"https://*/landing*", "https://shop.example.com/a/landing?x=1", true},
+		{"*a*b*c", "xaybzc", true},
+		{"*a*b*c", "xaybzcd", false},
+		{"a**", "a", true},
+		{"*", "", true},
+		{"", "", true},
+		{"", "a", false},
+		{"ab*ba", "aba", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+
+	// Backtracking into every star would take forever on this
+	pattern := strings.Repeat("*a", 30) + "b"
+	done := make(chan bool)
+	go func() { done <- globMatch(pattern, strings.Repeat("a", 100)) }()
+	select {
+	case got := <-done:
+		if got {
+			t.Errorf("globMatch(%q, a...) = true, want false", pattern)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("globMatch took over a second on a pattern with many stars")
+	}
+}
+
+func TestChallengePages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/origin-403":
+			w.Header().Set("CF-Ray", "abc-LHR")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<h1>Forbidden</h1>"))
+		case "/challenge":
+			w.Header().Set("CF-Ray", "abc-LHR")
+			w.Header().Set("Cf-Mitigated", "challenge")
+			w.WriteHeader(http.StatusForbidden)
+		case "/incapsula":
+			w.Header().Set("X-Iinfo", "1-2-3")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<html><script src="/_Incapsula_Resource?SWJIYLWA=1"></script></html>`))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path        string
+		failOnError bool
+		wantBlocked bool
+		wantErr     error
+	}{
+		{"/origin-403", false, false, nil},
+		{"/challenge", false, true, nil},
+		{"/challenge", true, true, ErrBlocked},
+		{"/incapsula", false, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, hops, err := followRedirects(context.Background(), server.URL+tt.path, TraceOptions{FailOnError: tt.failOnError})
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("followRedirects: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if blocked := strings.HasPrefix(hops[0].Note, "blocked by"); blocked != tt.wantBlocked {
+				t.Errorf("note = %q, want blocked = %v", hops[0].Note, tt.wantBlocked)
+			}
+		})
+	}
+}
+
+func TestHostCycle(t *testing.T) {
+	// a.test -> b.test -> c.test -> a.test ..., with a new path every hop so no URL repeats
+	next := map[string]string{"a.test": "b.test", "b.test": "c.test", "c.test": "a.test"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		host, port, _ := strings.Cut(r.Host, ":")
+		http.Redirect(w, r, "http://"+next[host]+":"+port+"/"+strconv.Itoa(n+1), http.StatusFound)
+	}))
+	defer server.Close()
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+	client := createHTTPClient(ClientOptions{Resolve: map[string]string{"a.test": "127.0.0.1", "b.test": "127.0.0.1", "c.test": "127.0.0.1"}})
+
+	_, hops, err := followRedirects(context.Background(), "http://a.test:"+port+"/0", TraceOptions{Client: client})
+	if !errors.Is(err, ErrCyclicRedirect) {
+		t.Fatalf("err = %v, want ErrCyclicRedirect with no hop cap", err)
+	}
+	if len(hops) > 3*cycleRepeats {
+		t.Errorf("got %d hops, want the cycle caught by its %dth round", len(hops), cycleRepeats)
+	}
+}
+
+func TestUnwrapQueryParam(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		param    string
+		want     string
+	}{
+		{
+			"encoded colon and slashes",
+			"https://login.example.com/auth?returnUri=https%3A%2F%2Fapp.example.com%2Fhome&utm_source=x",
+			"returnUri",
+			"https://login.example.com/auth?returnUri=https%3A%2F%2Fapp.example.com%2Fhome",
+		},
+		{
+			"literal %3A in the value survives",
+			"https://login.example.com/auth?redir=https%3A%2F%2Fapp.example.com%2Fa%253Ab",
+			"redir",
+			"https://login.example.com/auth?redir=https%3A%2F%2Fapp.example.com%2Fa%253Ab",
+		},
+		{
+			"& and # in the value stay inside it",
+			"https://login.example.com/auth?returnUri=https%3A%2F%2Fapp.example.com%2F%3Fa%3D1%26b%3D2%23top",
+			"returnUri",
+			"https://login.example.com/auth?returnUri=https%3A%2F%2Fapp.example.com%2F%3Fa%3D1%26b%3D2%23top",
+		},
+		{"no such param", "https://login.example.com/auth?next=x", "redir", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := unwrapQueryParam(u, tt.param)
+			if got != tt.want {
+				t.Errorf("unwrapQueryParam = %q, want %q", got, tt.want)
+			}
+			if got == "" {
+				return
+			}
+
+			// The value comes back out exactly as the Location carried it
+			back, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if back.Query().Get(tt.param) != u.Query().Get(tt.param) {
+				t.Errorf("value round-trips to %q, want %q", back.Query().Get(tt.param), u.Query().Get(tt.param))
+			}
+		})
+	}
+}
+
+func TestGroupByFinalJSON(t *testing.T) {
+	server := newChainServer(t)
+
+	urls := []string{server.URL + "/hop/1", server.URL + "/hop/2"}
+	out := captureStdout(t, func() {
+		runBatch(context.Background(), urls, TraceOptions{}, BatchOptions{OutputJSON: true, GroupByFinal: true, SortBy: "input"})
+	})
+
+	var grouped struct {
+		SchemaVersion int `json:"schemaVersion"`
+		Groups        []struct {
+			Host    string            `json:"host"`
+			Count   int               `json:"count"`
+			Results []json.RawMessage `json:"results"`
+		} `json:"groups"`
+	}
+	if err := json.Unmarshal(out, &grouped); err != nil {
+		t.Fatalf("output isn't a JSON object: %v\n%s", err, out)
+	}
+	if grouped.SchemaVersion != schemaVersion {
+		t.Errorf("schemaVersion = %d, want %d", grouped.SchemaVersion, schemaVersion)
+	}
+	if len(grouped.Groups) != 1 || grouped.Groups[0].Count != 2 || len(grouped.Groups[0].Results) != 2 {
+		t.Errorf("got %+v, want one group holding both results", grouped.Groups)
+	}
+}
+
+func TestMarkHopsFailedChain(t *testing.T) {
+	server := newChainServer(t)
+
+	_, hops, err := followRedirects(context.Background(), server.URL+"/hop/5", TraceOptions{MaxHops: 2})
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("err = %v, want ErrTooManyRedirects", err)
+	}
+	for i, hop := range hops {
+		last := i == len(hops)-1
+		if hop.IsFinal || hop.IsRedirect == last {
+			t.Errorf("hop %d: IsFinal = %v, IsRedirect = %v; a failed chain has no final hop, and doesn't move on from its last", hop.Number, hop.IsFinal, hop.IsRedirect)
+		}
+	}
+}
+
+func TestUnshorten(t *testing.T) {
+	server := newRedirectServer(t)
+
+	got, err := Unshorten(context.Background(), server.URL+statusPath(301))
+	if err != nil {
+		t.Fatalf("Unshorten: %v", err)
+	}
+	if want := server.URL + "/done"; got != want {
+		t.Errorf("Unshorten = %q, want %q", got, want)
+	}
+
+	if _, err := Unshorten(context.Background(), server.URL+"/no-location"); err == nil {
+		t.Error("Unshorten of a redirect with no Location: got no error")
+	}
+}
+
+func TestHopTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dribble":
+			// The Location comes at once, the body slowly
+			w.Header().Set("Location", "/done")
+			w.WriteHeader(http.StatusFound)
+			for i := 0; i < 10; i++ {
+				w.Write([]byte("x"))
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+		case "/silent":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	opts := TraceOptions{HopTimeout: 50 * time.Millisecond}
+
+	_, hops, err := followRedirects(context.Background(), server.URL+"/dribble", opts)
+	if err != nil {
+		t.Fatalf("followRedirects: %v", err)
+	}
+	if len(hops) != 2 || !hops[0].TimedOut {
+		t.Errorf("got %d hops (first TimedOut: %v), want the slow redirect marked TimedOut and followed", len(hops), len(hops) > 0 && hops[0].TimedOut)
+	}
+
+	_, hops, err = followRedirects(context.Background(), server.URL+"/silent", opts)
+	if !errors.Is(err, ErrHopTimeout) {
+		t.Fatalf("err = %v, want ErrHopTimeout", err)
+	}
+	if len(hops) != 1 || !hops[0].TimedOut {
+		t.Errorf("got %d hops, want the one that timed out", len(hops))
+	}
+}
@@ -2,4 +2,21 @@ module url-tracer
 
 go 1.23.5
 
-require github.com/pelletier/go-toml/v2 v2.2.3
+require (
+	github.com/pelletier/go-toml/v2 v2.2.3
+	github.com/quic-go/quic-go v0.54.1
+	golang.org/x/term v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/quic-go/qpack v0.5.1 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)